@@ -1,6 +1,9 @@
 package amqp
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -60,6 +63,64 @@ func TestAMQP(t *testing.T) {
 		m := b.CreateNewAMQPBulk(testBulk)
 		So(m, ShouldResemble, expectedMessage)
 	})
+	Convey("Mixed bulk in headers format", t, func() {
+		hb := Publisher{
+			Config: ConfigPublisher{Format: FormatHeaders},
+			Log:    logger.NewNopLogger(),
+		}
+		testBulk := []*elkstreams.LogMessage{
+			&elkstreams.LogMessage{
+				IndexName: "index-1",
+				IndexType: "type1",
+				Body:      []byte("{\"message1\":\"content1\"}"),
+			},
+			&elkstreams.LogMessage{
+				IndexName: "index-2",
+				IndexType: "type2",
+				Body:      []byte("{\"message2\":\"content2\"}"),
+			},
+			&elkstreams.LogMessage{
+				IndexName: "index-1",
+				IndexType: "type1",
+				Body:      []byte("{\"message3\":\"content3\"}"),
+			},
+		}
+		Convey("Publish", func() {
+			m := hb.createPublishings(testBulk)
+			So(m, ShouldResemble, []amqp.Publishing{
+				amqp.Publishing{
+					Headers: amqp.Table{"index": "index-1", "type": "type1"},
+					Body:    []byte("{\"message1\":\"content1\"}\n{\"message3\":\"content3\"}\n"),
+				},
+				amqp.Publishing{
+					Headers: amqp.Table{"index": "index-2", "type": "type2"},
+					Body:    []byte("{\"message2\":\"content2\"}\n"),
+				},
+			})
+		})
+		Convey("Receive", func() {
+			m, err := decodeAMQPBulk(&amqp.Delivery{
+				Headers: amqp.Table{"index": "index-1", "type": "type1"},
+				Body:    []byte("{\"message1\":\"content1\"}\n{\"message3\":\"content3\"}\n"),
+			})
+			So(err, ShouldBeNil)
+			So(m, ShouldResemble, []*elkstreams.LogMessage{testBulk[0], testBulk[2]})
+		})
+		Convey("Receive without index header", func() {
+			_, err := decodeAMQPBulkNew(&amqp.Delivery{
+				Headers: amqp.Table{"index": ""},
+				Body:    []byte("{\"message1\":\"content1\"}\n"),
+			})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Legacy format is detected", func() {
+			m, err := decodeAMQPBulk(&amqp.Delivery{
+				Body: b.CreateAMQPBulk(testBulk).Body,
+			})
+			So(err, ShouldBeNil)
+			So(m, ShouldResemble, testBulk)
+		})
+	})
 	Convey("A few messages in bulk", t, func() {
 		indexName := "index"
 		indexType := "type"
@@ -135,4 +196,145 @@ func TestAMQP(t *testing.T) {
 			So(m, ShouldResemble, testBulk)
 		})
 	})
+	Convey("Confirms should be matched with publishings", t, func() {
+		tracker := newConfirmTracker()
+		tag1, confirm1 := tracker.add()
+		tag2, confirm2 := tracker.add()
+		tag3, confirm3 := tracker.add()
+		So(tag1, ShouldEqual, 1)
+		So(tag2, ShouldEqual, 2)
+		So(tag3, ShouldEqual, 3)
+
+		tracker.confirm(amqp.Confirmation{DeliveryTag: 2, Ack: false})
+		tracker.confirm(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+		So(<-confirm1, ShouldBeTrue)
+		So(<-confirm2, ShouldBeFalse)
+
+		tracker.close()
+		_, ok := <-confirm3
+		So(ok, ShouldBeFalse)
+
+		_, confirm4 := tracker.add()
+		_, ok = <-confirm4
+		So(ok, ShouldBeFalse)
+	})
+	Convey("Spool should keep publishings in order", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		s, err := openSpool(SpoolConfig{Dir: dir, SegmentSize: 1, MaxSize: 100})
+		So(err, ShouldBeNil)
+		So(s.empty(), ShouldBeTrue)
+
+		msg1 := amqp.Publishing{Body: []byte("{\"message1\":\"content1\"}\n")}
+		msg2 := amqp.Publishing{Headers: amqp.Table{"index": "index-abc"}, Body: []byte("{\"message2\":\"content2\"}\n")}
+		So(s.write(msg1), ShouldBeNil)
+		So(s.write(msg2), ShouldBeNil)
+		So(s.write(msg1), ShouldEqual, errSpoolFull)
+		So(s.empty(), ShouldBeFalse)
+
+		segments := s.seal()
+		So(len(segments), ShouldEqual, 2)
+
+		Convey("and not replay them without connection", func() {
+			p := &Publisher{Log: logger.NewNopLogger(), spool: s}
+			p.replaySpool()
+			So(len(s.seal()), ShouldEqual, 2)
+		})
+
+		Convey("and load them after restart", func() {
+			reopened, err := openSpool(SpoolConfig{Dir: dir})
+			So(err, ShouldBeNil)
+			So(reopened.bytes(), ShouldEqual, s.bytes())
+			So(len(reopened.seal()), ShouldEqual, 2)
+		})
+
+		m, err := readSpoolSegment(segments[0].path)
+		So(err, ShouldBeNil)
+		So(m, ShouldResemble, []amqp.Publishing{msg1})
+		m, err = readSpoolSegment(segments[1].path)
+		So(err, ShouldBeNil)
+		So(m, ShouldResemble, []amqp.Publishing{msg2})
+
+		So(s.remove(segments[0]), ShouldBeNil)
+		So(s.remove(segments[1]), ShouldBeNil)
+		So(s.empty(), ShouldBeTrue)
+		So(s.bytes(), ShouldEqual, 0)
+	})
+	Convey("Only failed messages are encoded for retry", t, func() {
+		status := &elkstreams.DeliveryStatus{}
+		bulk := []*elkstreams.LogMessage{
+			&elkstreams.LogMessage{IndexName: "index-abc", IndexType: "type-abc", Body: []byte("{\"message1\":\"content1\"}"), Status: status},
+			&elkstreams.LogMessage{IndexName: "index-def", IndexType: "type-def", Body: []byte("{\"message2\":\"content2\"}"), Status: status},
+			&elkstreams.LogMessage{IndexName: "index-def", IndexType: "type-def", Body: []byte("{\"message3\":\"content3\"}"), Status: status},
+		}
+		bulk[1].Fail(fmt.Errorf("elasticsearch responded with status 429"), false)
+		bulk[2].Fail(fmt.Errorf("elasticsearch responded with status 400"), true)
+		permanent, err := status.Err()
+		So(err, ShouldNotBeNil)
+		So(permanent, ShouldBeFalse)
+		retry, rejected := status.Failed()
+		So(retry, ShouldResemble, bulk[1:2])
+		So(rejected, ShouldResemble, bulk[2:])
+
+		Convey("in legacy format", func() {
+			delivery := &amqp.Delivery{Body: encodeAMQPBulk(&amqp.Delivery{}, retry)}
+			m, err := decodeAMQPBulk(delivery)
+			So(err, ShouldBeNil)
+			So(len(m), ShouldEqual, 1)
+			So(m[0].IndexName, ShouldEqual, "index-def")
+			So(m[0].IndexType, ShouldEqual, "type-def")
+			So(string(m[0].Body), ShouldEqual, "{\"message2\":\"content2\"}")
+		})
+		Convey("in headers format", func() {
+			headers := amqp.Table{"index": "index-def", "type": "type-def"}
+			body := encodeAMQPBulk(&amqp.Delivery{Headers: headers}, retry)
+			So(string(body), ShouldEqual, "{\"message2\":\"content2\"}\n")
+		})
+	})
+	Convey("Consumer without metric storage", t, func() {
+		c := &Consumer{Log: logger.NewNopLogger()}
+		So(c.Start(), ShouldBeNil)
+		So(c.Stop(), ShouldBeNil)
+	})
+	Convey("Closed channel errors are detected", t, func() {
+		So(isClosedError(amqp.ErrClosed), ShouldBeTrue)
+		So(isClosedError(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}), ShouldBeTrue)
+		So(isClosedError(&amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"}), ShouldBeFalse)
+		So(isClosedError(fmt.Errorf("publishing was rejected by broker")), ShouldBeFalse)
+	})
+	Convey("Messages failed max retries times should not be republished", t, func() {
+		session := &Session{Log: logger.NewNopLogger(), Config: ConnectionConfig{MaxRetries: 3}}
+		ack := &acknowledger{}
+		m := &amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{RetryCountHeader: int32(3)}}
+		So(retryCount(m), ShouldEqual, 3)
+		So(retryCount(&amqp.Delivery{}), ShouldEqual, 0)
+		status := &elkstreams.DeliveryStatus{}
+		bulk := []*elkstreams.LogMessage{{IndexName: "index", IndexType: "type", Body: []byte("{}"), Status: status}}
+		bulk[0].Fail(fmt.Errorf("elasticsearch responded with status 429"), false)
+		session.rejectDelivery(m, bulk, status)
+		So(ack.nacked, ShouldBeTrue)
+		So(ack.requeued, ShouldBeFalse)
+		So(ack.acked, ShouldBeFalse)
+	})
+}
+
+// acknowledger keeps acknowledgement of delivery
+type acknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
 }
@@ -4,13 +4,33 @@ import (
 	"time"
 )
 
+const (
+	// FormatLegacy is a format of AMQP message with Elasticsearch bulk API body
+	FormatLegacy = "legacy"
+	// FormatHeaders is a format of AMQP message with index and type in headers and NDJSON body
+	FormatHeaders = "headers"
+)
+
 // ConfigPublisher setting
 type ConfigPublisher struct {
-	URL               string `yaml:"url"`
-	Exchange          string `yaml:"exchange"`
-	RoutingKey        string `yaml:"key"`
-	PublishTimeout    int64  `yaml:"publish_timeout"`
-	ReconnectInterval int64  `yaml:"reconnect_interval"`
+	URL               string      `yaml:"url"`
+	Exchange          string      `yaml:"exchange"`
+	RoutingKey        string      `yaml:"key"`
+	PublishTimeout    int64       `yaml:"publish_timeout"`
+	ReconnectInterval int64       `yaml:"reconnect_interval"`
+	Format            string      `yaml:"format"`
+	Spool             SpoolConfig `yaml:"spool"`
+	MetricsMaxLabels  int         `yaml:"metrics_max_labels"`
+}
+
+// SpoolConfig settings of on-disk spool, spool is disabled when dir is empty,
+// replay is at-least-once: a segment is removed only when all its bulks are confirmed,
+// so bulks of a segment which replay was interrupted are published again on the next replay
+type SpoolConfig struct {
+	Dir         string `yaml:"dir"`
+	SegmentSize int64  `yaml:"segment_size"`
+	SegmentAge  int64  `yaml:"segment_age"`
+	MaxSize     int64  `yaml:"max_size"`
 }
 
 // ConnectionConfig settings
@@ -24,6 +44,17 @@ type ConnectionConfig struct {
 	reconnectInterval time.Duration
 	WaitAck           string `yaml:"wait_ack"`
 	waitAck           bool
+	// MaxRetries is a number of republishings of temporarily failed messages before they are dead-lettered
+	// or dropped, DefaultMaxRetries is used when it is not set
+	MaxRetries int              `yaml:"max_retries"`
+	DeadLetter DeadLetterConfig `yaml:"dead_letter"`
+}
+
+// DeadLetterConfig settings of exchange and queue for undecodable and failed messages, dead-lettering is disabled when exchange is empty
+type DeadLetterConfig struct {
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"key"`
+	Queue      string `yaml:"queue"`
 }
 
 // ConfigConsumer settings
@@ -0,0 +1,79 @@
+package amqp
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmTracker matches publisher confirms with publishings of one channel
+type confirmTracker struct {
+	sync.Mutex
+	deliveryTag uint64
+	pending     map[uint64]chan bool
+	closed      bool
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{
+		pending: make(map[uint64]chan bool),
+	}
+}
+
+// add registers next publishing and returned channel for its confirm,
+// must be called in the same order as publishings are sent to channel
+func (t *confirmTracker) add() (uint64, chan bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.deliveryTag++
+	confirm := make(chan bool, 1)
+	if t.closed {
+		close(confirm)
+	} else {
+		t.pending[t.deliveryTag] = confirm
+	}
+	return t.deliveryTag, confirm
+}
+
+// remove forgets publishing that is no longer waited for
+func (t *confirmTracker) remove(deliveryTag uint64) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.pending, deliveryTag)
+}
+
+// confirm passes broker ack or nack to waiting publishing
+func (t *confirmTracker) confirm(c amqp.Confirmation) {
+	t.Lock()
+	defer t.Unlock()
+	if confirm, ok := t.pending[c.DeliveryTag]; ok {
+		confirm <- c.Ack
+		delete(t.pending, c.DeliveryTag)
+	}
+}
+
+// close fails all waiting publishings, it is called when channel is closed
+func (t *confirmTracker) close() {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	for deliveryTag, confirm := range t.pending {
+		close(confirm)
+		delete(t.pending, deliveryTag)
+	}
+}
+
+// run dispatches confirms until channel is closed
+func (t *confirmTracker) run(confirms <-chan amqp.Confirmation) {
+	for c := range confirms {
+		t.confirm(c)
+	}
+	t.close()
+}
+
+// pendingConfirm is a publishing waiting for broker confirm
+type pendingConfirm struct {
+	tracker     *confirmTracker
+	deliveryTag uint64
+	ack         chan bool
+}
@@ -7,20 +7,26 @@ import (
 
 // Consumer type
 type Consumer struct {
-	Config    ConfigConsumer
-	Publisher elkstreams.Publisher
-	Log       elkstreams.Logger
-	sessions  []*Session
+	Config        ConfigConsumer
+	Publisher     elkstreams.Publisher
+	Log           elkstreams.Logger
+	MetricStorage elkstreams.MetricStorage
+	sessions      []*Session
 }
 
 // Start consumer
 func (consumer *Consumer) Start() error {
+	var deadLetters elkstreams.MetricCounter
+	if consumer.MetricStorage != nil {
+		deadLetters = consumer.MetricStorage.RegisterCounter("amqp.dead_letters.total")
+	}
 	consumer.sessions = make([]*Session, len(consumer.Config.Connections))
 	for i, sessionConfig := range consumer.Config.Connections {
 		consumer.sessions[i] = &Session{
-			Config: sessionConfig,
-			Publisher: consumer.Publisher,
-			Log:    logger.With(consumer.Log.(*logger.Logger), "session", i),
+			Config:      sessionConfig,
+			Publisher:   consumer.Publisher,
+			Log:         logger.With(consumer.Log.(*logger.Logger), "session", i),
+			deadLetters: deadLetters,
 		}
 		if err := consumer.sessions[i].Start(); err != nil {
 			return err
@@ -8,28 +8,222 @@ import (
 	"github.com/streadway/amqp"
 
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/helpers"
 )
 
-// Publish publishes bulk to AMQP
+// Publish publishes bulk to AMQP and waits for broker confirms,
+// bulk is written to spool while broker is unavailable or spool is not replayed yet
 func (b *Publisher) Publish(bulk []*elkstreams.LogMessage) error {
-	msg := b.CreateAMQPBulk(bulk)
+	msgs := b.createPublishings(bulk)
 
-	if b.channel == nil {
-		return fmt.Errorf("channel is nil")
+	if b.spool != nil && !b.spool.empty() {
+		return b.spoolPublishings(msgs)
 	}
+
 	start := time.Now()
-	err := b.channel.Publish(
+	confirms := make([]*pendingConfirm, 0, len(msgs))
+	for i := range msgs {
+		confirm, err := b.publish(msgs[i])
+		if err == elkstreams.ErrNotConnected && b.spool != nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		confirms = append(confirms, confirm)
+	}
+	t := float64(time.Since(start) / time.Millisecond)
+	b.metrics.publushTimeTotal.Observe(t)
+	b.metrics.publishBulksTotal.Add(float64(len(confirms)))
+	b.metrics.publishMessagesTotal.Add(float64(len(bulk)))
+	b.observeIndices(bulk)
+
+	// publishings which were not sent or confirmed because channel was closed are spooled in order,
+	// unconfirmed ones may be duplicated after replay
+	for i, confirm := range confirms {
+		err := b.waitConfirm(confirm)
+		if err == elkstreams.ErrNotConnected && b.spool != nil {
+			return b.spoolPublishings(msgs[i:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(confirms) < len(msgs) {
+		return b.spoolPublishings(msgs[len(confirms):])
+	}
+	b.metrics.confirmTime.Observe(float64(time.Since(start) / time.Millisecond))
+	return nil
+}
+
+// observeIndices updates per-index counters of bulks and messages, index date suffix is stripped
+func (b *Publisher) observeIndices(bulk []*elkstreams.LogMessage) {
+	messages := make(map[string]int)
+	for _, message := range bulk {
+		messages[helpers.IndexPrefix(message.IndexName)]++
+	}
+	for prefix, count := range messages {
+		b.metrics.byIndex.Add(prefix, "bulks", 1)
+		b.metrics.byIndex.Add(prefix, "messages", float64(count))
+	}
+}
+
+// createPublishings returned AMQP messages in configured format,
+// in headers format a mixed bulk is split to one message per index and type
+func (b *Publisher) createPublishings(bulk []*elkstreams.LogMessage) []amqp.Publishing {
+	if b.Config.Format != FormatHeaders {
+		return []amqp.Publishing{b.CreateAMQPBulk(bulk)}
+	}
+
+	type indexKey struct {
+		name, typ string
+	}
+	var (
+		order  []indexKey
+		groups = make(map[indexKey][]*elkstreams.LogMessage)
+	)
+	for _, message := range bulk {
+		key := indexKey{message.IndexName, message.IndexType}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], message)
+	}
+	msgs := make([]amqp.Publishing, 0, len(order))
+	for _, key := range order {
+		msgs = append(msgs, b.CreateNewAMQPBulk(groups[key]))
+	}
+	return msgs
+}
+
+// publish sends message to channel and returned its pending confirm
+func (b *Publisher) publish(msg amqp.Publishing) (*pendingConfirm, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.channel == nil {
+		return nil, elkstreams.ErrNotConnected
+	}
+	deliveryTag, ack := b.confirms.add()
+	if err := b.channel.Publish(
 		b.Config.Exchange,
 		b.Config.RoutingKey,
 		false,
 		false,
-		msg)
-	// timer := time.NewTimer(time.Duration(b.Config.PublishTimeout) * time.Second)
-	t := float64(time.Since(start) / time.Millisecond)
-	b.metrics.publushTimeTotal.Observe(t)
-	b.metrics.publishBulksTotal.Add(1)
-	b.metrics.publishMessagesTotal.Add(float64(len(bulk)))
-	return err
+		msg); err != nil {
+		b.confirms.remove(deliveryTag)
+		if isClosedError(err) {
+			b.Log.Warn("msg", "can't publish to closed channel", "err", err)
+			return nil, elkstreams.ErrNotConnected
+		}
+		return nil, err
+	}
+	return &pendingConfirm{
+		tracker:     b.confirms,
+		deliveryTag: deliveryTag,
+		ack:         ack,
+	}, nil
+}
+
+// waitConfirm waits for broker ack up to publish_timeout, zero timeout means wait forever
+func (b *Publisher) waitConfirm(confirm *pendingConfirm) error {
+	var timeout <-chan time.Time
+	if b.Config.PublishTimeout > 0 {
+		timer := time.NewTimer(time.Duration(b.Config.PublishTimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ack, ok := <-confirm.ack:
+		if !ok {
+			b.Log.Warn("msg", "channel was closed before publishing was confirmed")
+			return elkstreams.ErrNotConnected
+		}
+		if !ack {
+			b.metrics.nacksTotal.Add(1)
+			return fmt.Errorf("publishing was rejected by broker")
+		}
+		return nil
+	case <-timeout:
+		confirm.tracker.remove(confirm.deliveryTag)
+		b.metrics.confirmTimeoutsTotal.Add(1)
+		return elkstreams.ErrPublishTimeout
+	}
+}
+
+// isClosedError returned true if publishing failed because channel or connection was closed
+func isClosedError(err error) bool {
+	if err == amqp.ErrClosed {
+		return true
+	}
+	e, ok := err.(*amqp.Error)
+	return ok && (e.Code == amqp.ChannelError || e.Code == amqp.ConnectionForced)
+}
+
+func (b *Publisher) spoolPublishings(msgs []amqp.Publishing) error {
+	for i := range msgs {
+		if err := b.spool.write(msgs[i]); err != nil {
+			b.metrics.spoolDropped.Add(float64(len(msgs) - i))
+			b.Log.Error("msg", "can't write bulk to spool", "err", err)
+			return elkstreams.ErrNotConnected
+		}
+	}
+	b.metrics.spoolBytes.Set(float64(b.spool.bytes()))
+	return nil
+}
+
+// replaySpool publishes spooled bulks in order until spool is empty or publishing failed,
+// a segment is removed only when all its publishings are confirmed so bulks may be duplicated
+func (b *Publisher) replaySpool() {
+	if b.spool == nil || b.spool.empty() {
+		return
+	}
+	b.mu.Lock()
+	connected := b.channel != nil
+	b.mu.Unlock()
+	if !connected {
+		return
+	}
+	for !b.spool.empty() {
+		for _, segment := range b.spool.seal() {
+			select {
+			case <-b.tomb.Dying():
+				return
+			default:
+			}
+			if err := b.replaySegment(segment); err != nil {
+				b.Log.Warn("msg", "spool replay interrupted", "segment", segment.path, "err", err)
+				return
+			}
+		}
+	}
+}
+
+func (b *Publisher) replaySegment(segment *spoolSegment) error {
+	messages, readErr := readSpoolSegment(segment.path)
+	if readErr != nil {
+		b.Log.Error("msg", "spool segment is corrupted, only readable bulks will be replayed", "segment", segment.path, "err", readErr)
+	}
+	confirms := make([]*pendingConfirm, 0, len(messages))
+	for i := range messages {
+		confirm, err := b.publish(messages[i])
+		if err != nil {
+			return err
+		}
+		confirms = append(confirms, confirm)
+	}
+	for _, confirm := range confirms {
+		if err := b.waitConfirm(confirm); err != nil {
+			return err
+		}
+	}
+	if err := b.spool.remove(segment); err != nil {
+		b.Log.Error("msg", "can't remove replayed spool segment", "segment", segment.path, "err", err)
+	}
+	b.metrics.spoolReplayed.Add(float64(len(messages)))
+	b.metrics.spoolBytes.Set(float64(b.spool.bytes()))
+	b.Log.Info("msg", "spool segment replayed", "segment", segment.path, "bulks", len(messages))
+	return nil
 }
 
 // CreateAMQPBulk return AMQP message in legacy format
@@ -48,7 +242,7 @@ func (b *Publisher) CreateAMQPBulk(bulk []*elkstreams.LogMessage) (amqpBulk amqp
 func (b *Publisher) CreateNewAMQPBulk(bulk []*elkstreams.LogMessage) (amqpBulk amqp.Publishing) {
 	amqpBulk.Headers = amqp.Table{
 		"index": bulk[0].IndexName,
-		"type": bulk[0].IndexType,
+		"type":  bulk[0].IndexType,
 	}
 	var body bytes.Buffer
 	for i := range bulk {
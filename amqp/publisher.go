@@ -2,12 +2,14 @@ package amqp
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 	"gopkg.in/tomb.v2"
 
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/helpers"
 )
 
 // Publisher is an AMQP implementation of elkstreams.Publisher interface
@@ -15,39 +17,59 @@ type Publisher struct {
 	Config        ConfigPublisher
 	Log           elkstreams.Logger
 	MetricStorage elkstreams.MetricStorage
-	connection    *amqp.Connection
-	channel       *amqp.Channel
-	amqpErrors    chan *amqp.Error
+	// mu guards connection, channel and confirms
+	mu         sync.Mutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	confirms   *confirmTracker
+	amqpErrors chan *amqp.Error
+	spool      *spool
 
 	tomb    tomb.Tomb
 	metrics struct {
 		publushTimeTotal     elkstreams.MetricHistogram
 		publishBulksTotal    elkstreams.MetricCounter
 		publishMessagesTotal elkstreams.MetricCounter
-		// publishBulksByIndex
-		// publishMessagesByIndex
+		confirmTime          elkstreams.MetricHistogram
+		nacksTotal           elkstreams.MetricCounter
+		confirmTimeoutsTotal elkstreams.MetricCounter
+		spoolBytes           elkstreams.MetricGauge
+		spoolReplayed        elkstreams.MetricCounter
+		spoolDropped         elkstreams.MetricCounter
+		byIndex              *helpers.LabeledCounters
 	}
 }
 
 func (b *Publisher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.close()
+}
+
+func (b *Publisher) close() {
 	if b.channel != nil {
 		b.channel.Close()
+		b.channel = nil
 	}
 	if b.connection != nil {
 		b.connection.Close()
+		b.connection = nil
 	}
+	b.amqpErrors = nil
 }
 
-func (b *Publisher) makeConnection() error {
-	b.Close()
-	var err error
-	defer func(err error) {
+func (b *Publisher) makeConnection() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.close()
+	defer func() {
 		if err != nil {
+			b.close()
 			b.Log.Error("msg", "connection failed", "err", err)
 		} else {
 			b.Log.Info("msg", "connection established")
 		}
-	}(err)
+	}()
 
 	if b.connection, err = amqp.Dial(b.Config.URL); err != nil {
 		return err
@@ -56,6 +78,12 @@ func (b *Publisher) makeConnection() error {
 	if b.channel, err = b.connection.Channel(); err != nil {
 		return err
 	}
+	if err = b.channel.Confirm(false); err != nil {
+		return fmt.Errorf("cannot put channel into confirm mode: %v", err)
+	}
+	b.confirms = newConfirmTracker()
+	go b.confirms.run(b.channel.NotifyPublish(make(chan amqp.Confirmation, 1024)))
+
 	b.amqpErrors = make(chan *amqp.Error, 1)
 	b.channel.NotifyClose(b.amqpErrors)
 	if err = b.channel.ExchangeDeclare(
@@ -75,26 +103,55 @@ func (b *Publisher) makeConnection() error {
 
 // Start initializes AMQP connections
 func (b *Publisher) Start() error {
+	switch b.Config.Format {
+	case "":
+		b.Config.Format = FormatLegacy
+	case FormatLegacy, FormatHeaders:
+	default:
+		return fmt.Errorf("unknown format '%s', expected '%s' or '%s'", b.Config.Format, FormatLegacy, FormatHeaders)
+	}
+
 	b.metrics.publushTimeTotal = b.MetricStorage.RegisterHistogram("amqp.publish_time.total")
 	b.metrics.publishBulksTotal = b.MetricStorage.RegisterCounter("amqp.bulks.total")
 	b.metrics.publishMessagesTotal = b.MetricStorage.RegisterCounter("amqp.messages.total")
+	b.metrics.confirmTime = b.MetricStorage.RegisterHistogram("amqp.confirm_time.total")
+	b.metrics.nacksTotal = b.MetricStorage.RegisterCounter("amqp.nacks.total")
+	b.metrics.confirmTimeoutsTotal = b.MetricStorage.RegisterCounter("amqp.confirm_timeouts.total")
+	b.metrics.spoolBytes = b.MetricStorage.RegisterGauge("amqp.spool.bytes")
+	b.metrics.spoolReplayed = b.MetricStorage.RegisterCounter("amqp.spool.replayed")
+	b.metrics.spoolDropped = b.MetricStorage.RegisterCounter("amqp.spool.dropped")
+	b.metrics.byIndex = helpers.NewLabeledCounters(b.MetricStorage, "amqp.index", b.Config.MetricsMaxLabels)
+
+	if b.Config.Spool.Dir != "" {
+		var err error
+		if b.spool, err = openSpool(b.Config.Spool); err != nil {
+			return err
+		}
+		b.metrics.spoolBytes.Set(float64(b.spool.bytes()))
+	}
 
 	b.tomb.Go(func() error {
 		b.makeConnection()
+		b.replaySpool()
 		ticker := time.NewTicker(time.Second * time.Duration(b.Config.ReconnectInterval))
 		for {
 			select {
 			case <-b.tomb.Dying(): // Exit
 				b.Close()
+				if b.spool != nil {
+					b.spool.close()
+				}
 				return nil
 			case err := <-b.amqpErrors:
 				b.Log.Error("msg", "error communicating with remote server", "error", err)
+				b.Close()
 				time.Sleep(time.Second * time.Duration(b.Config.ReconnectInterval))
 				b.makeConnection()
 			case <-ticker.C:
 				if b.connection == nil || b.channel == nil {
 					b.makeConnection()
 				}
+				b.replaySpool()
 			}
 		}
 	})
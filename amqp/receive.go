@@ -44,6 +44,64 @@ func decodeAMQPBulkLegacy(message *amqp.Delivery) ([]*elkstreams.LogMessage, err
 	return decodedBulk, nil
 }
 
-func (consumer *Consumer) decodeAMQPBulkNew(message amqp.Delivery) []*elkstreams.LogMessage {
-	return nil
+// decodeAMQPBulk detects format of message by headers and decodes it
+func decodeAMQPBulk(message *amqp.Delivery) ([]*elkstreams.LogMessage, error) {
+	if _, ok := message.Headers["index"]; ok {
+		return decodeAMQPBulkNew(message)
+	}
+	return decodeAMQPBulkLegacy(message)
+}
+
+func decodeAMQPBulkNew(message *amqp.Delivery) ([]*elkstreams.LogMessage, error) {
+	indexName := headerString(message.Headers, "index")
+	if len(indexName) == 0 {
+		return nil, fmt.Errorf("empty index name")
+	}
+	indexType := headerString(message.Headers, "type")
+
+	var decodedBulk []*elkstreams.LogMessage
+	for _, line := range bytes.Split(message.Body, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		decodedBulk = append(decodedBulk, &elkstreams.LogMessage{
+			IndexName: indexName,
+			IndexType: indexType,
+			Body:      line,
+		})
+	}
+	if len(decodedBulk) < 1 {
+		return nil, fmt.Errorf("empty message")
+	}
+	return decodedBulk, nil
+}
+
+func headerString(headers amqp.Table, name string) string {
+	switch v := headers[name].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+// encodeAMQPBulk encodes messages in the format of source delivery
+func encodeAMQPBulk(message *amqp.Delivery, bulk []*elkstreams.LogMessage) []byte {
+	_, headersFormat := message.Headers["index"]
+	var body bytes.Buffer
+	for _, m := range bulk {
+		if !headersFormat {
+			var header BulkHeader
+			header.Index.MessageIndex = m.IndexName
+			header.Index.MessageType = m.IndexType
+			line, _ := json.Marshal(header)
+			body.Write(line)
+			body.WriteByte('\n')
+		}
+		body.Write(m.Body)
+		body.WriteByte('\n')
+	}
+	return body.Bytes()
 }
@@ -15,18 +15,27 @@ import (
 const (
 	// ConsumerName AMQP ConsumerName
 	ConsumerName = "elkriver"
+	// DeadLetterReasonHeader is a header of dead-lettered message with the reason why it was not processed
+	DeadLetterReasonHeader = "x-elkriver-error"
+	// RetryCountHeader is a header of republished message with the number of its retries
+	RetryCountHeader = "x-elkriver-retries"
+	// DefaultMaxRetries is used when max_retries is not set
+	DefaultMaxRetries = 10
 )
 
 type Session struct {
-	Config     ConnectionConfig
-	Log        elkstreams.Logger
-	Publisher  elkstreams.Publisher
-	connection *amqp.Connection
-	channel    *amqp.Channel
-	delivery   <-chan amqp.Delivery
-	amqpErrors chan *amqp.Error
-	tomb       tomb.Tomb
-	active     bool
+	Config      ConnectionConfig
+	Log         elkstreams.Logger
+	Publisher   elkstreams.Publisher
+	deadLetters elkstreams.MetricCounter // optional, nil if consumer has no metric storage
+	connection  *amqp.Connection
+	channel     *amqp.Channel
+	confirms    *confirmTracker
+	publishMu   sync.Mutex // guards publishing with its confirm tracking
+	delivery    <-chan amqp.Delivery
+	amqpErrors  chan *amqp.Error
+	tomb        tomb.Tomb
+	active      bool
 }
 
 func (session *Session) tryConnect() {
@@ -45,6 +54,14 @@ func (session *Session) tryConnect() {
 		session.Log.Error("msg", "can't create channel", "err", err)
 		return
 	}
+	if err = session.channel.Confirm(false); err != nil {
+		session.Log.Error("msg", "can't put channel into confirm mode", "err", err)
+		return
+	}
+	session.publishMu.Lock()
+	session.confirms = newConfirmTracker()
+	go session.confirms.run(session.channel.NotifyPublish(make(chan amqp.Confirmation, 1024)))
+	session.publishMu.Unlock()
 
 	if err = PreparePipe(
 		session.channel,
@@ -55,6 +72,17 @@ func (session *Session) tryConnect() {
 		session.Log.Error("msg", "prepare rabbitmq failed, maybe queue, exchange or bind alreary exists with bad settings", "err", err)
 		return
 	}
+	if len(session.Config.DeadLetter.Exchange) > 0 {
+		if err = PreparePipe(
+			session.channel,
+			session.Config.DeadLetter.Exchange,
+			session.Config.DeadLetter.RoutingKey,
+			session.Config.DeadLetter.Queue,
+		); err != nil {
+			session.Log.Error("msg", "prepare dead letter exchange failed", "err", err)
+			return
+		}
+	}
 	if session.Config.PrefetchCount < 1 {
 		session.Log.Error("msg", "prefetch_count can't equal 0")
 		return
@@ -68,10 +96,10 @@ func (session *Session) tryConnect() {
 		session.Config.Queue,    // queue
 		ConsumerName,            // consumer
 		!session.Config.waitAck, // autoAck
-		false, // exclusive
-		true,  // noLocal - separate connections for Channel.Consume and ACKs
-		false, // noWait
-		nil,   // args
+		false,                   // exclusive
+		true,                    // noLocal - separate connections for Channel.Consume and ACKs
+		false,                   // noWait
+		nil,                     // args
 	); err != nil {
 		session.Log.Error("msg", "can't delivery channel", "err", err)
 		return
@@ -117,6 +145,9 @@ func (session *Session) createStableConnect() error {
 func (session *Session) Start() error {
 	session.Config.reconnectInterval = time.Duration(session.Config.ReconnectInterval) * time.Second
 	session.Config.waitAck = helpers.ToBool(session.Config.WaitAck)
+	if session.Config.MaxRetries < 1 {
+		session.Config.MaxRetries = DefaultMaxRetries
+	}
 	session.tomb.Go(session.createStableConnect)
 	return nil
 }
@@ -136,9 +167,21 @@ func (session *Session) get() {
 				}
 				return
 			}
-			bulk, err := decodeAMQPBulkLegacy(&m)
+			bulk, err := decodeAMQPBulk(&m)
 			if err != nil {
-				session.Log.Warn("msg", "bad message", "err", err, "body", string(m.Body))
+				session.Log.Warn("msg", "bad message", "err", err, "size", len(m.Body))
+				session.Log.Debug("msg", "bad message", "body", string(m.Body))
+				if len(session.Config.DeadLetter.Exchange) > 0 {
+					if dlErr := session.deadLetter(&m, m.Body, err); dlErr != nil {
+						session.Log.Error("msg", "can't publish message to dead letter exchange", "err", dlErr)
+						if session.Config.waitAck {
+							if err := m.Nack(false, true); err != nil {
+								session.Log.Warn("msg", "can't send nack for bad message", "err", err)
+							}
+						}
+						return
+					}
+				}
 				if session.Config.waitAck {
 					// удаляем из рэббита плохие сообщения
 					if err := m.Ack(false); err != nil {
@@ -149,12 +192,18 @@ func (session *Session) get() {
 			}
 			if session.Config.waitAck {
 				var ack sync.WaitGroup
+				status := &elkstreams.DeliveryStatus{}
 				ack.Add(len(bulk))
 				for i, _ := range bulk {
 					bulk[i].Ack = &ack
+					bulk[i].Status = status
 				}
 				session.Publisher.Publish(bulk)
 				ack.Wait()
+				if _, err := status.Err(); err != nil {
+					session.rejectDelivery(&m, bulk, status)
+					return
+				}
 				if err := m.Ack(false); err != nil {
 					session.Log.Warn("msg", "can't send ack", "err", err)
 				}
@@ -182,6 +231,133 @@ func (session *Session) get() {
 	// session.amqpErrors <- amqp.ErrClosed приводит к panic: send on closed channel
 }
 
+// rejectDelivery publishes temporarily failed messages of delivery again as a new delivery,
+// so messages which were already indexed are not indexed twice after retry,
+// permanently failed messages and messages retried max_retries times are dead-lettered if it is configured or dropped otherwise
+func (session *Session) rejectDelivery(m *amqp.Delivery, bulk []*elkstreams.LogMessage, status *elkstreams.DeliveryStatus) {
+	permanent, reason := status.Err()
+	retry, rejected := status.Failed()
+	if len(retry)+len(rejected) == 0 {
+		if permanent {
+			rejected = bulk
+		} else {
+			retry = bulk
+		}
+	}
+	if retries := retryCount(m); len(retry) > 0 && retries >= session.Config.MaxRetries {
+		session.Log.Warn("msg", "messages failed too many times", "count", len(retry), "retries", retries, "err", reason)
+		rejected = append(rejected, retry...)
+		retry = nil
+	}
+	if len(rejected) > 0 {
+		session.Log.Warn("msg", "messages failed permanently", "count", len(rejected), "err", reason)
+		if len(session.Config.DeadLetter.Exchange) > 0 {
+			if err := session.deadLetter(m, encodeAMQPBulk(m, rejected), reason); err != nil {
+				session.Log.Error("msg", "can't publish message to dead letter exchange", "err", err)
+				if err := m.Nack(false, true); err != nil {
+					session.Log.Warn("msg", "can't send nack", "err", err)
+				}
+				return
+			}
+		} else if len(retry) == 0 {
+			if err := m.Nack(false, false); err != nil {
+				session.Log.Warn("msg", "can't send nack", "err", err)
+			}
+			return
+		}
+	}
+	if len(retry) > 0 {
+		session.Log.Warn("msg", "messages failed, republish them", "count", len(retry), "err", reason)
+		if err := session.republish(m, encodeAMQPBulk(m, retry)); err != nil {
+			session.Log.Error("msg", "can't republish failed messages, requeue delivery", "err", err)
+			if err := m.Nack(false, true); err != nil {
+				session.Log.Warn("msg", "can't send nack", "err", err)
+			}
+			return
+		}
+	}
+	if err := m.Ack(false); err != nil {
+		session.Log.Warn("msg", "can't send ack", "err", err)
+	}
+}
+
+// retryCount returned number of retries of delivery from its header
+func retryCount(m *amqp.Delivery) int {
+	switch v := m.Headers[RetryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// republish publishes body with headers of delivery and increased retry count directly to the consumed queue,
+// other queues bound to the consumed exchange do not get the message twice
+func (session *Session) republish(m *amqp.Delivery, body []byte) error {
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(retryCount(m) + 1)
+	return session.publish("", session.Config.Queue, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Timestamp:       m.Timestamp,
+		Body:            body,
+	})
+}
+
+// publish sends publishing to exchange and waits for broker confirm
+func (session *Session) publish(exchange, key string, msg amqp.Publishing) error {
+	session.publishMu.Lock()
+	confirms := session.confirms
+	deliveryTag, ack := confirms.add()
+	if err := session.channel.Publish(exchange, key, false, false, msg); err != nil {
+		confirms.remove(deliveryTag)
+		session.publishMu.Unlock()
+		return err
+	}
+	session.publishMu.Unlock()
+
+	confirmed, ok := <-ack
+	if !ok {
+		return fmt.Errorf("channel was closed before publishing was confirmed")
+	}
+	if !confirmed {
+		return fmt.Errorf("publishing was rejected by broker")
+	}
+	return nil
+}
+
+// deadLetter publishes body with headers of original message and the error reason to dead letter exchange
+// and waits for broker confirm, so the original message may be acked only when nil is returned
+func (session *Session) deadLetter(m *amqp.Delivery, body []byte, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[DeadLetterReasonHeader] = reason.Error()
+	if err := session.publish(session.Config.DeadLetter.Exchange, session.Config.DeadLetter.RoutingKey, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Timestamp:       m.Timestamp,
+		Body:            body,
+	}); err != nil {
+		return err
+	}
+	if session.deadLetters != nil {
+		session.deadLetters.Add(1)
+	}
+	return nil
+}
+
 func (session *Session) Stop() error {
 	session.Log.Debug("msg", "stop")
 	session.tomb.Go(func() error {
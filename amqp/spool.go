@@ -0,0 +1,219 @@
+package amqp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const spoolSegmentExt = ".spool"
+
+var errSpoolFull = fmt.Errorf("spool is full")
+
+// spoolSegment is a file with spooled publishings
+type spoolSegment struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+// spool is an on-disk write-ahead queue of publishings,
+// it is used while connection to the broker is not established
+type spool struct {
+	config   SpoolConfig
+	mu       sync.Mutex
+	segments []*spoolSegment
+	current  *os.File
+	size     int64
+}
+
+// openSpool loads segments left from previous run
+func openSpool(config SpoolConfig) (*spool, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("can't create spool directory: %v", err)
+	}
+	files, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read spool directory: %v", err)
+	}
+	s := &spool{config: config}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{
+			path:    filepath.Join(config.Dir, f.Name()),
+			size:    f.Size(),
+			created: f.ModTime(),
+		})
+		s.size += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].path < s.segments[j].path
+	})
+	return s, nil
+}
+
+// empty returned true if there are no spooled publishings
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) == 0
+}
+
+// bytes returned total size of spool
+func (s *spool) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// write appends publishing to the current segment
+func (s *spool) write(msg amqp.Publishing) error {
+	record, err := encodeSpoolRecord(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.MaxSize > 0 && s.size+int64(len(record)) > s.config.MaxSize {
+		return errSpoolFull
+	}
+	if s.current != nil {
+		segment := s.segments[len(s.segments)-1]
+		if (s.config.SegmentSize > 0 && segment.size >= s.config.SegmentSize) ||
+			(s.config.SegmentAge > 0 && time.Since(segment.created) >= time.Duration(s.config.SegmentAge)*time.Second) {
+			s.closeCurrent()
+		}
+	}
+	if s.current == nil {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.current.Write(record)
+	s.segments[len(s.segments)-1].size += int64(n)
+	s.size += int64(n)
+	return err
+}
+
+func (s *spool) openSegment() error {
+	now := time.Now()
+	path := filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", now.UnixNano(), spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("can't create spool segment: %v", err)
+	}
+	s.current = f
+	s.segments = append(s.segments, &spoolSegment{path: path, created: now})
+	return nil
+}
+
+func (s *spool) closeCurrent() {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+}
+
+// seal closes the current segment and returned all segments in order,
+// new publishings are written to the next segment
+func (s *spool) seal() []*spoolSegment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCurrent()
+	segments := make([]*spoolSegment, len(s.segments))
+	copy(segments, s.segments)
+	return segments
+}
+
+// remove deletes replayed segment
+func (s *spool) remove(segment *spoolSegment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.segments {
+		if s.segments[i] == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= segment.size
+			break
+		}
+	}
+	return os.Remove(segment.path)
+}
+
+// close closes the current segment
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCurrent()
+}
+
+// encodeSpoolRecord returned publishing as length-prefixed headers and body
+func encodeSpoolRecord(msg amqp.Publishing) ([]byte, error) {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode headers: %v", err)
+	}
+	record := make([]byte, 8+len(headers)+len(msg.Body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(headers)))
+	copy(record[4:], headers)
+	binary.BigEndian.PutUint32(record[4+len(headers):8+len(headers)], uint32(len(msg.Body)))
+	copy(record[8+len(headers):], msg.Body)
+	return record, nil
+}
+
+// readSpoolSegment returned publishings from segment, on error it returned publishings read before it
+func readSpoolSegment(path string) ([]amqp.Publishing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		result []amqp.Publishing
+		r      = bufio.NewReader(f)
+		length = make([]byte, 4)
+	)
+	readPart := func() ([]byte, error) {
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+		part := make([]byte, binary.BigEndian.Uint32(length))
+		_, err := io.ReadFull(r, part)
+		return part, err
+	}
+	for {
+		headers, err := readPart()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("truncated record: %v", err)
+		}
+		body, err := readPart()
+		if err != nil {
+			return result, fmt.Errorf("truncated record: %v", err)
+		}
+		var msg amqp.Publishing
+		if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+			return result, fmt.Errorf("can't decode headers: %v", err)
+		}
+		msg.Body = body
+		result = append(result, msg)
+	}
+}
@@ -7,24 +7,31 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/AlexAkulov/candy-elk/amqp"
-	"github.com/AlexAkulov/candy-elk/elastic"
+	"github.com/AlexAkulov/candy-elk/logger"
 	"github.com/AlexAkulov/candy-elk/metrics"
+	"github.com/AlexAkulov/candy-elk/notifier"
+	"github.com/AlexAkulov/candy-elk/notifier/meta"
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+	"github.com/AlexAkulov/candy-elk/notifier/sender"
 	"github.com/AlexAkulov/candy-elk/profiler"
 )
 
 type config struct {
 	Logfile   string              `yaml:"logfile"`
 	LogLevel  string              `yaml:"loglevel"`
+	LogFormat string              `yaml:"log_format"`
+	LogRotate logger.RotateConfig `yaml:"log_rotate"`
 	Consumer  amqp.ConfigConsumer `yaml:"amqp"`
-	Publisher elastic.Config      `yaml:"elastic"`
+	Notifier  notifier.Config     `yaml:"notifier"`
 	Metrics   metrics.Config      `yaml:"metrics"`
 	Profiling profiler.Config     `yaml:"pprof"`
 }
 
 func defaultConfig() *config {
 	return &config{
-		LogLevel: "debug",
-		Logfile:  "stdout",
+		LogLevel:  "debug",
+		LogFormat: logger.FormatLogfmt,
+		Logfile:   "stdout",
 		Consumer: amqp.ConfigConsumer{
 			Connections: []amqp.ConnectionConfig{
 				amqp.ConnectionConfig{
@@ -32,21 +39,40 @@ func defaultConfig() *config {
 					Exchange:          "guest",
 					RoutingKey:        "guest",
 					Queue:             "guest",
+					PrefetchCount:     1000,
 					ReconnectInterval: 2,
 					WaitAck:           "yes",
 				},
 			},
 		},
-		Publisher: elastic.Config{
-			ElasticUrls:         []string{"http://localhost:9200"},
-			BulkSize:            1000,
-			BulkRefreshInterval: 30,
-			ConcurentWrites:     10,
+		Notifier: notifier.Config{
+			ElasticUrls: []string{"http://localhost:9200"},
+			Rules: meta.Config{
+				Source:         meta.SourceElasticsearch,
+				ReloadInterval: meta.DefaultReloadInterval,
+			},
+			Scheduler: scheduler.Config{
+				Window:  60,
+				MaxRows: 100,
+			},
+			Senders: []sender.Config{
+				sender.Config{
+					Type:     sender.TypeMail,
+					From:     "elkalert@localhost",
+					SMTPHost: "localhost",
+					SMTPPort: 25,
+				},
+			},
 		},
 		Metrics: metrics.Config{
 			Enabled:                  true,
 			GraphiteConnectionString: "",
 			GraphitePrefix:           "DevOps",
+			Prometheus: metrics.PrometheusConfig{
+				Enabled:   false,
+				Listen:    ":9110",
+				Namespace: "elkalert",
+			},
 		},
 		Profiling: profiler.Config{
 			Enabled: "false",
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,8 +10,9 @@ import (
 	"github.com/jessevdk/go-flags"
 
 	"github.com/AlexAkulov/candy-elk/amqp"
-	"github.com/AlexAkulov/candy-elk/elastic"
 	"github.com/AlexAkulov/candy-elk/logger"
+	"github.com/AlexAkulov/candy-elk/metrics"
+	"github.com/AlexAkulov/candy-elk/notifier"
 	"github.com/AlexAkulov/candy-elk/profiler"
 )
 
@@ -21,7 +23,7 @@ var (
 
 func main() {
 	var opts struct {
-		ConfigLocation     string `short:"c" long:"config" description:"path to config yaml file" default:"elkriver.yml"`
+		ConfigLocation     string `short:"c" long:"config" description:"path to config yaml file" default:"elkalert.yml"`
 		PrintDefaultConfig bool   `long:"print-default-config" description:"Print default config and exit"`
 		Version            bool   `short:"v" long:"version" description:"print version and exit"`
 	}
@@ -30,7 +32,7 @@ func main() {
 	}
 
 	if opts.Version {
-		fmt.Println("elkriver:", version)
+		fmt.Println("elkalert:", version)
 		fmt.Println("Golang:", goVersion)
 		os.Exit(0)
 	}
@@ -46,17 +48,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	writer := os.Stdout
+	var (
+		writer  io.Writer = os.Stdout
+		logFile *logger.File
+	)
 	if config.Logfile != "" && config.Logfile != "stdout" {
 		var err error
-		if writer, err = os.OpenFile(config.Logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		if logFile, err = logger.OpenFile(config.Logfile, config.LogRotate); err != nil {
 			fmt.Fprintf(os.Stderr, "lvl=fatal msg=\"can't open logfile\" file=\"%s\" err=\"%s\"\n", config.Logfile, err)
 			os.Exit(1)
 		}
-		defer writer.Close()
+		defer logFile.Close()
+		writer = logFile
 	}
 
-	log := logger.New(config.LogLevel, writer)
+	log, err := logger.New(config.LogLevel, config.LogFormat, writer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lvl=fatal msg=\"can't set up logger\" err=\"%s\"\n", err)
+		os.Exit(1)
+	}
 
 	// Start
 
@@ -66,19 +76,29 @@ func main() {
 	}
 	p.Start()
 
-	es := &elastic.Publisher{
-		Config: config.Publisher,
-		Log:    logger.With(log, "component", "publisher"),
+	ms := &metrics.MetricStorage{
+		Config: config.Metrics,
+		Log:    logger.With(log, "component", "metrics"),
 	}
-	if err := es.Start(); err != nil {
-		log.Error("msg", "can't start publisher", "err", err)
+	if err := ms.Start(); err != nil {
+		log.Error("msg", "can't start metrics", "err", err)
+		os.Exit(1)
+	}
+
+	n := &notifier.Publisher{
+		Config: config.Notifier,
+		Log:    logger.With(log, "component", "notifier"),
+	}
+	if err := n.Start(); err != nil {
+		log.Error("msg", "can't start notifier", "err", err)
 		os.Exit(1)
 	}
 
 	c := &amqp.Consumer{
-		Config:    config.Consumer,
-		Log:       logger.With(log, "component", "consumer"),
-		Publisher: es,
+		Config:        config.Consumer,
+		Log:           logger.With(log, "component", "consumer"),
+		MetricStorage: ms,
+		Publisher:     n,
 	}
 	if err := c.Start(); err != nil {
 		log.Error("msg", "can't start consumer", "err", err)
@@ -88,18 +108,26 @@ func main() {
 	log.Info("msg", "started", "pid", os.Getpid(), "version", version)
 
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
-	log.Info("msg", "received signal", "signal", <-signalChannel)
+	for {
+		s := <-signalChannel
+		log.Info("msg", "received signal", "signal", s)
+		if s != syscall.SIGUSR1 {
+			break
+		}
+		logFile.ReopenOrWarn()
+	}
 
 	// Stop
 
 	if err := c.Stop(); err != nil {
 		log.Error("msg", "stop consumer", "err", err)
 	}
-	if err := es.Stop(); err != nil {
-		log.Error("msg", "stop publusher", "err", err)
+	if err := n.Stop(); err != nil {
+		log.Error("msg", "stop notifier", "err", err)
 	}
+	ms.Stop()
 	p.Stop()
 
 	log.Info("msg", "stopped", "pid", os.Getpid(), "version", version)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -26,6 +27,7 @@ func main() {
 		ConfigLocation     string `short:"c" long:"config" description:"path to config yaml file" default:"elkgate.yml"`
 		PrintDefaultConfig bool   `long:"print-default-config" description:"Print default config and exit"`
 		Version            bool   `short:"v" long:"version" description:"print version and exit"`
+		HashAPIKey         string `long:"hash-apikey" description:"print salted SHA-256 hash of apikey for api_keys and exit"`
 	}
 	if _, err := flags.Parse(&opts); err != nil {
 		os.Exit(0)
@@ -37,6 +39,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	if opts.HashAPIKey != "" {
+		hash, err := http.HashAPIKey(opts.HashAPIKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to hash apikey: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+
 	if opts.PrintDefaultConfig {
 		printDefaultConfig()
 		os.Exit(0)
@@ -48,17 +60,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	writer := os.Stdout
+	var (
+		writer  io.Writer = os.Stdout
+		logFile *logger.File
+	)
 	if config.Logfile != "" && config.Logfile != "stdout" {
 		var err error
-		if writer, err = os.OpenFile(config.Logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		if logFile, err = logger.OpenFile(config.Logfile, config.LogRotate); err != nil {
 			fmt.Fprintf(os.Stderr, "failed to open logfile %s: %s\n", config.Logfile, err)
 			os.Exit(1)
 		}
-		defer writer.Close()
+		defer logFile.Close()
+		writer = logFile
 	}
 
-	log = logger.New(config.LogLevel, writer)
+	log, err = logger.New(config.LogLevel, config.LogFormat, writer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logger: %s\n", err)
+		os.Exit(1)
+	}
 
 	metrics := &metrics.MetricStorage{
 		Config: config.Metrics,
@@ -91,11 +111,15 @@ func main() {
 	log.Info("msg", "started", "pid", os.Getpid(), "version", version)
 
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
 	for {
 		s := <-signalChannel
 		log.Info("msg", "received signal", "signal", s)
+		if s == syscall.SIGUSR1 {
+			logFile.ReopenOrWarn()
+			continue
+		}
 		if s != syscall.SIGHUP {
 			break
 		}
@@ -104,12 +128,22 @@ func main() {
 			log.Error("msg", "reload failed", "err", err)
 			continue
 		}
+		if err := http.CheckIndexRouting(config.HTTP.IndexRouting); err != nil {
+			log.Error("msg", "reload failed, previous config is used", "err", err)
+			continue
+		}
 		handler.Config = config.HTTP
+		if err := handler.ReloadTLS(); err != nil {
+			log.Error("msg", "tls reload failed, previous certificate is used", "err", err)
+		}
+		if err := handler.ReloadProcessors(); err != nil {
+			log.Error("msg", "processors reload failed, previous processors are used", "err", err)
+		}
 		log.SetLevel(config.LogLevel)
 		metrics.Log.SetLevel(config.LogLevel)
 		handler.Log.SetLevel(config.LogLevel)
 		publisher.Log.SetLevel(config.LogLevel)
-		log.Info("msg", "api-keys and loglevel was be reloaded")
+		log.Info("msg", "api-keys, rate limits, tls certificates, processors and loglevel was be reloaded")
 	}
 
 	mustStop(handler)
@@ -8,6 +8,7 @@ import (
 
 	"github.com/AlexAkulov/candy-elk/amqp"
 	"github.com/AlexAkulov/candy-elk/elastic"
+	"github.com/AlexAkulov/candy-elk/logger"
 	"github.com/AlexAkulov/candy-elk/metrics"
 	"github.com/AlexAkulov/candy-elk/profiler"
 )
@@ -15,6 +16,8 @@ import (
 type config struct {
 	Logfile   string              `yaml:"logfile"`
 	LogLevel  string              `yaml:"loglevel"`
+	LogFormat string              `yaml:"log_format"`
+	LogRotate logger.RotateConfig `yaml:"log_rotate"`
 	Consumer  amqp.ConfigConsumer `yaml:"amqp"`
 	Publisher elastic.Config      `yaml:"elastic"`
 	Metrics   metrics.Config      `yaml:"metrics"`
@@ -23,8 +26,9 @@ type config struct {
 
 func defaultConfig() *config {
 	return &config{
-		LogLevel: "debug",
-		Logfile:  "stdout",
+		LogLevel:  "debug",
+		LogFormat: logger.FormatLogfmt,
+		Logfile:   "stdout",
 		Consumer: amqp.ConfigConsumer{
 			Connections: []amqp.ConnectionConfig{
 				amqp.ConnectionConfig{
@@ -35,6 +39,7 @@ func defaultConfig() *config {
 					PrefetchCount:     1000,
 					ReconnectInterval: 2,
 					WaitAck:           "yes",
+					MaxRetries:        amqp.DefaultMaxRetries,
 				},
 			},
 		},
@@ -44,11 +49,18 @@ func defaultConfig() *config {
 			BulkSize:            1000,
 			BulkRefreshInterval: 30,
 			ConcurentWrites:     10,
+			RetryCount:          5,
+			RetryMaxInterval:    60,
 		},
 		Metrics: metrics.Config{
 			Enabled:                  true,
 			GraphiteConnectionString: "",
 			GraphitePrefix:           "DevOps",
+			Prometheus: metrics.PrometheusConfig{
+				Enabled:   false,
+				Listen:    ":9109",
+				Namespace: "elkriver",
+			},
 		},
 		Profiling: profiler.Config{
 			Enabled: "false",
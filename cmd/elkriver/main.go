@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +14,7 @@ import (
 	"github.com/AlexAkulov/candy-elk/elastic/es2x"
 	"github.com/AlexAkulov/candy-elk/elastic/es6x"
 	"github.com/AlexAkulov/candy-elk/logger"
+	"github.com/AlexAkulov/candy-elk/metrics"
 	"github.com/AlexAkulov/candy-elk/profiler"
 )
 
@@ -48,17 +50,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	writer := os.Stdout
+	var (
+		writer  io.Writer = os.Stdout
+		logFile *logger.File
+	)
 	if config.Logfile != "" && config.Logfile != "stdout" {
 		var err error
-		if writer, err = os.OpenFile(config.Logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		if logFile, err = logger.OpenFile(config.Logfile, config.LogRotate); err != nil {
 			fmt.Fprintf(os.Stderr, "lvl=fatal msg=\"can't open logfile\" file=\"%s\" err=\"%s\"\n", config.Logfile, err)
 			os.Exit(1)
 		}
-		defer writer.Close()
+		defer logFile.Close()
+		writer = logFile
 	}
 
-	log := logger.New(config.LogLevel, writer)
+	log, err := logger.New(config.LogLevel, config.LogFormat, writer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lvl=fatal msg=\"can't set up logger\" err=\"%s\"\n", err)
+		os.Exit(1)
+	}
 
 	// Start
 
@@ -68,6 +78,15 @@ func main() {
 	}
 	p.Start()
 
+	ms := &metrics.MetricStorage{
+		Config: config.Metrics,
+		Log:    logger.With(log, "component", "metrics"),
+	}
+	if err := ms.Start(); err != nil {
+		log.Error("msg", "can't start metrics", "err", err)
+		os.Exit(1)
+	}
+
 	var es elkstreams.Publisher
 	switch config.Publisher.Version {
 	case "2x":
@@ -90,9 +109,10 @@ func main() {
 	}
 
 	c := &amqp.Consumer{
-		Config:    config.Consumer,
-		Log:       logger.With(log, "component", "consumer"),
-		Publisher: es,
+		Config:        config.Consumer,
+		Log:           logger.With(log, "component", "consumer"),
+		MetricStorage: ms,
+		Publisher:     es,
 	}
 	if err := c.Start(); err != nil {
 		log.Error("msg", "can't start consumer", "err", err)
@@ -102,9 +122,16 @@ func main() {
 	log.Info("msg", "started", "pid", os.Getpid(), "version", version)
 
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
-	log.Info("msg", "received signal", "signal", <-signalChannel)
+	for {
+		s := <-signalChannel
+		log.Info("msg", "received signal", "signal", s)
+		if s != syscall.SIGUSR1 {
+			break
+		}
+		logFile.ReopenOrWarn()
+	}
 
 	// Stop
 
@@ -114,6 +141,7 @@ func main() {
 	if err := es.Stop(); err != nil {
 		log.Error("msg", "stop publusher", "err", err)
 	}
+	ms.Stop()
 	p.Stop()
 
 	log.Info("msg", "stopped", "pid", os.Getpid(), "version", version)
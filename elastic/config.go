@@ -1,5 +1,10 @@
 package elastic
 
+import (
+	"net/http"
+	"time"
+)
+
 // Config setting
 type Config struct {
 	Version             string   `yaml:"version"`
@@ -7,4 +12,24 @@ type Config struct {
 	BulkSize            uint     `yaml:"bulk_size"`
 	BulkRefreshInterval int64    `yaml:"bulk_refresh_interval"`
 	ConcurentWrites     uint     `yaml:"concurent_writes"`
+	RetryCount          int      `yaml:"retry_count"`
+	RetryMaxInterval    int64    `yaml:"retry_max_interval"`
+}
+
+// RetryInterval returned exponential backoff interval for failed bulk attempt capped by retry_max_interval
+func (c Config) RetryInterval(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
+	interval := time.Second << uint(attempt)
+	maxInterval := time.Duration(c.RetryMaxInterval) * time.Second
+	if maxInterval > 0 && interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// IsPermanentFailure returned true if document with this status will not be indexed on retry
+func IsPermanentFailure(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
 }
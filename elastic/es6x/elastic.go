@@ -3,6 +3,7 @@ package es6x
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/AlexAkulov/candy-elk"
@@ -90,23 +91,36 @@ func (b *bulk) Fire(notifier muster.Notifier) {
 		res *es6x.BulkResponse
 		err error
 	)
-	for {
+	for attempt := 0; ; attempt++ {
 		ctx := context.Background()
 		res, err = bulkRequest.Do(ctx)
-		if err != nil {
-			b.Publisher.Log.Error("msg", "failed write bulk to es", "err", err, "count", len(b.Items))
-			// Return messages to RabbitMQ
-			// for i, _ := range b.Items {
-			// 	// b.Items[i].Nack()
-			// }
-			time.Sleep(time.Second * 10)
-			continue
+		if err == nil {
+			break
+		}
+		if attempt >= b.Publisher.Config.RetryCount {
+			b.Publisher.Log.Error("msg", "failed write bulk to es, giving up", "err", err, "count", len(b.Items), "attempts", attempt+1)
+			for i := range b.Items {
+				b.Items[i].Fail(err, false)
+				if b.Items[i].Ack != nil {
+					b.Items[i].Ack.Done()
+				}
+			}
+			return
 		}
-		break
+		interval := b.Publisher.Config.RetryInterval(attempt)
+		b.Publisher.Log.Error("msg", "failed write bulk to es", "err", err, "count", len(b.Items), "retry_in", interval)
+		time.Sleep(interval)
 	}
 	failed := res.Failed()
 	b.Publisher.processLostMessages(failed)
-	for i, _ := range b.Items {
+	for i := range b.Items {
+		if i < len(res.Items) {
+			for _, item := range res.Items[i] {
+				if item.Status >= 300 {
+					b.Items[i].Fail(fmt.Errorf("elasticsearch responded with status %d", item.Status), elastic.IsPermanentFailure(item.Status))
+				}
+			}
+		}
 		if b.Items[i].Ack != nil {
 			b.Items[i].Ack.Done()
 		}
@@ -1,9 +1,17 @@
 package elkstreams
 
 import (
+	"errors"
 	"sync"
 )
 
+var (
+	// ErrNotConnected is returned by Publisher when connection to the broker is not established
+	ErrNotConnected = errors.New("not connected to broker")
+	// ErrPublishTimeout is returned by Publisher when publishing was not confirmed in time
+	ErrPublishTimeout = errors.New("publishing was not confirmed in time")
+)
+
 type DecodedLogMessage struct {
 	IndexName string
 	IndexType string
@@ -16,6 +24,60 @@ type LogMessage struct {
 	IndexType string
 	Body      []byte
 	Ack       *sync.WaitGroup
+	Status    *DeliveryStatus
+}
+
+// Fail reports that message was not delivered, permanent failure means that retry will not help
+func (m *LogMessage) Fail(err error, permanent bool) {
+	if m.Status != nil {
+		m.Status.fail(m, err, permanent)
+	}
+}
+
+// DeliveryStatus collects failures of messages from the same source bulk
+type DeliveryStatus struct {
+	mu        sync.Mutex
+	err       error
+	permanent bool
+	retry     []*LogMessage
+	rejected  []*LogMessage
+}
+
+// Fail stores the first failure, the delivery is permanently failed only if all its failures are permanent
+func (s *DeliveryStatus) Fail(err error, permanent bool) {
+	s.fail(nil, err, permanent)
+}
+
+func (s *DeliveryStatus) fail(m *LogMessage, err error, permanent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m != nil {
+		if permanent {
+			s.rejected = append(s.rejected, m)
+		} else {
+			s.retry = append(s.retry, m)
+		}
+	}
+	if s.err == nil {
+		s.err = err
+		s.permanent = permanent
+		return
+	}
+	s.permanent = s.permanent && permanent
+}
+
+// Err returned the first failure and whether the delivery is failed permanently
+func (s *DeliveryStatus) Err() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.permanent, s.err
+}
+
+// Failed returned failed messages which can be retried and permanently rejected ones
+func (s *DeliveryStatus) Failed() (retry, rejected []*LogMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retry, s.rejected
 }
 
 // Publisher is a way to publish logs
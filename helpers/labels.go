@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/AlexAkulov/candy-elk"
+)
+
+const (
+	// OverflowLabel is used for all labels over the cardinality cap
+	OverflowLabel = "_other"
+	// UnknownLabel is used for empty labels
+	UnknownLabel = "_unknown"
+)
+
+var (
+	indexDateSuffix = regexp.MustCompile(`[-_.]\d{4}([-_.]?w\d{2}|([-_.]?\d{2}){0,2})$`)
+	badLabelChars   = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// IndexPrefix returned index name without date suffix like -2006.01.02, -2006.01, -20060102 or weekly -2006.w01
+func IndexPrefix(index string) string {
+	return indexDateSuffix.ReplaceAllString(index, "")
+}
+
+// KeyProject returned project name of API key, it is the part of key before the first dash,
+// the key itself is never returned to avoid leaking secrets to metrics
+func KeyProject(key string) string {
+	if i := strings.Index(key, "-"); i > 0 {
+		return key[:i]
+	}
+	return UnknownLabel
+}
+
+// LabeledCounters lazily registers counters named <prefix>.<label>.<name>, storages with labels
+// like Prometheus get one counter <prefix>.<name> with label named by the last part of prefix instead,
+// only first maxLabels distinct labels get own counters and others are accounted as OverflowLabel
+type LabeledCounters struct {
+	storage   elkstreams.MetricStorage
+	prefix    string
+	labelName string
+	maxLabels int
+	mu        sync.Mutex
+	labels    map[string]map[string]elkstreams.MetricCounter
+}
+
+// NewLabeledCounters creates set of labeled counters, zero maxLabels means no cap
+func NewLabeledCounters(storage elkstreams.MetricStorage, prefix string, maxLabels int) *LabeledCounters {
+	return &LabeledCounters{
+		storage:   storage,
+		prefix:    prefix,
+		labelName: prefix[strings.LastIndex(prefix, ".")+1:],
+		maxLabels: maxLabels,
+		labels:    make(map[string]map[string]elkstreams.MetricCounter),
+	}
+}
+
+// Add increases counter name of label
+func (c *LabeledCounters) Add(label, name string, delta float64) {
+	label = badLabelChars.ReplaceAllString(label, "_")
+	if label == "" {
+		label = UnknownLabel
+	}
+
+	c.mu.Lock()
+	counters, ok := c.labels[label]
+	if !ok {
+		if c.maxLabels > 0 && len(c.labels) >= c.maxLabels {
+			label = OverflowLabel
+			counters = c.labels[label]
+		}
+		if counters == nil {
+			counters = make(map[string]elkstreams.MetricCounter)
+			c.labels[label] = counters
+		}
+	}
+	counter, ok := counters[name]
+	if !ok {
+		graphiteName := c.prefix + "." + label + "." + name
+		if storage, ok := c.storage.(elkstreams.LabeledMetricStorage); ok {
+			counter = storage.RegisterLabeledCounter(graphiteName, c.prefix+"."+name, c.labelName, label)
+		} else {
+			counter = c.storage.RegisterCounter(graphiteName)
+		}
+		counters[name] = counter
+	}
+	c.mu.Unlock()
+
+	counter.Add(delta)
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk/helpers"
+)
+
+// APIKey settings, in YAML it is either a list of index patterns or a map with settings.
+// Name of apikey is the key itself unless hash is set, then the key is verified by salted SHA-256 or bcrypt hash
+// and a key with bcrypt hash must start with the name of apikey and '-', e.g. ops-<secret> for apikey ops
+type APIKey struct {
+	Owner       string
+	Hash        string
+	Indices     []string
+	Types       []string
+	Expires     time.Time
+	Enabled     bool
+	MaxBodySize int64
+}
+
+// apiKeyYAML is a map form of APIKey in YAML
+type apiKeyYAML struct {
+	Owner       string   `yaml:"owner"`
+	Hash        string   `yaml:"hash"`
+	Indices     []string `yaml:"indices"`
+	Types       []string `yaml:"types"`
+	Expires     string   `yaml:"expires"`
+	Enabled     *bool    `yaml:"enabled"`
+	MaxBodySize int64    `yaml:"max_body_size"`
+}
+
+// UnmarshalYAML accepts both old list of index patterns and map with settings
+func (k *APIKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var indices []string
+	if err := unmarshal(&indices); err == nil {
+		*k = APIKey{Indices: indices, Enabled: true}
+		return nil
+	}
+
+	var raw apiKeyYAML
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*k = APIKey{
+		Owner:       raw.Owner,
+		Hash:        raw.Hash,
+		Indices:     raw.Indices,
+		Types:       raw.Types,
+		Enabled:     raw.Enabled == nil || *raw.Enabled,
+		MaxBodySize: raw.MaxBodySize,
+	}
+	if raw.Hash != "" {
+		if err := checkHash(raw.Hash); err != nil {
+			return err
+		}
+	}
+	if raw.Expires != "" {
+		var err error
+		if k.Expires, err = parseExpires(raw.Expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalYAML writes APIKey in map form
+func (k APIKey) MarshalYAML() (interface{}, error) {
+	raw := apiKeyYAML{
+		Owner:       k.Owner,
+		Hash:        k.Hash,
+		Indices:     k.Indices,
+		Types:       k.Types,
+		Enabled:     &k.Enabled,
+		MaxBodySize: k.MaxBodySize,
+	}
+	if !k.Expires.IsZero() {
+		raw.Expires = k.Expires.Format(time.RFC3339)
+	}
+	return raw, nil
+}
+
+func parseExpires(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expires '%s', expected RFC3339 time or YYYY-MM-DD date", s)
+}
+
+// Expired returned true if key has expiry time and it has passed
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// OwnerName returned owner of apikey, name of hashed apikey or project part of plain key when owner is not set
+func (k APIKey) OwnerName(name string) string {
+	if k.Owner != "" {
+		return k.Owner
+	}
+	if k.Hash != "" {
+		return name
+	}
+	return helpers.KeyProject(name)
+}
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"fmt"
+
+	"github.com/AlexAkulov/candy-elk"
+)
+
+var (
+	errQueueFull   = fmt.Errorf("async queue is full, try again later")
+	errQueueClosed = fmt.Errorf("server is shutting down, try again later")
+)
+
+// enqueue puts bulk to async queue without blocking, bulk is not accepted once the queue is draining
+func (h *Server) enqueue(bulk []*elkstreams.LogMessage) error {
+	h.queueMu.RLock()
+	defer h.queueMu.RUnlock()
+	if h.queueClosed {
+		return errQueueClosed
+	}
+	select {
+	case h.queue <- bulk:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// asyncWorker publishes bulks from async queue until server is stopped, then drains the queue
+func (h *Server) asyncWorker() error {
+	for {
+		select {
+		case bulk := <-h.queue:
+			h.publishAsync(bulk)
+		case <-h.tomb.Dying():
+			h.closeQueue()
+			for {
+				select {
+				case bulk := <-h.queue:
+					h.publishAsync(bulk)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// closeQueue stops accepting bulks to async queue, bulks which are being enqueued are put before it returns
+func (h *Server) closeQueue() {
+	h.queueMu.Lock()
+	h.queueClosed = true
+	h.queueMu.Unlock()
+}
+
+func (h *Server) publishAsync(bulk []*elkstreams.LogMessage) {
+	h.metrics.queueLength.Set(float64(len(h.queue)))
+	if err := h.Publisher.Publish(bulk); err != nil {
+		h.metrics.asyncErrors.Add(1)
+		h.Log.Error("index", bulk[0].IndexName, "type", bulk[0].IndexType, "msg", "async publishing failed", "count", len(bulk), "error", err)
+	}
+}
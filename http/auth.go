@@ -5,28 +5,63 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func (h *Server) authorize(header string, esIndex string) (int, error) {
+// authenticate returned name of apikey from Authorization header, the key must be enabled and not expired
+func (h *Server) authenticate(header string) (string, int, error) {
 	//  headers => { "Authorization" => "ELK devops-uepinruJhq82BAPWnjaw89sJ" }
 	parts := strings.Split(header, " ")
 
 	if len(parts) != 2 {
-		return http.StatusUnauthorized, fmt.Errorf("bad authorization header (must be in the form ELK project-apikey)")
+		return "", http.StatusUnauthorized, fmt.Errorf("bad authorization header (must be in the form ELK project-apikey)")
 	}
 	if parts[0] != "ELK" {
-		return http.StatusUnauthorized, fmt.Errorf("bad authorization header (must start with ELK)")
+		return "", http.StatusUnauthorized, fmt.Errorf("bad authorization header (must start with ELK)")
 	}
 
-	key := parts[1]
-	if _, keyExists := h.Config.APIKeys[key]; !keyExists {
-		return http.StatusUnauthorized, fmt.Errorf("apikey '%s' not found in configuration", key)
+	key, apiKey, keyExists := h.findAPIKey(parts[1])
+	if !keyExists {
+		return "", http.StatusUnauthorized, fmt.Errorf("apikey not found in configuration")
 	}
+	if !apiKey.Enabled {
+		return "", http.StatusUnauthorized, fmt.Errorf("apikey of '%s' is disabled", apiKey.OwnerName(key))
+	}
+	if apiKey.Expired(time.Now()) {
+		return "", http.StatusUnauthorized, fmt.Errorf("apikey of '%s' expired at %s", apiKey.OwnerName(key), apiKey.Expires.Format(time.RFC3339))
+	}
+	return key, 0, nil
+}
 
-	for _, indexPattern := range h.Config.APIKeys[key] {
+// checkIndex checks that index is allowed for apikey
+func (h *Server) checkIndex(key string, esIndex string) (int, error) {
+	apiKey, _ := h.apiKey(key)
+	for _, indexPattern := range apiKey.Indices {
 		if matched, _ := filepath.Match(indexPattern, esIndex); matched {
 			return 0, nil
 		}
 	}
-	return http.StatusForbidden, fmt.Errorf("index '%s' is not allowed for apikey '%s'", esIndex, key)
+	return http.StatusForbidden, fmt.Errorf("index '%s' is not allowed for apikey of '%s'", esIndex, apiKey.OwnerName(key))
+}
+
+// checkType checks that index type is allowed for apikey, all types are allowed when types are not set
+func (h *Server) checkType(key string, esType string) (int, error) {
+	apiKey, _ := h.apiKey(key)
+	if len(apiKey.Types) == 0 {
+		return 0, nil
+	}
+	for _, typePattern := range apiKey.Types {
+		if matched, _ := filepath.Match(typePattern, esType); matched {
+			return 0, nil
+		}
+	}
+	return http.StatusForbidden, fmt.Errorf("type '%s' is not allowed for apikey of '%s'", esType, apiKey.OwnerName(key))
+}
+
+// maxBodySize returned body size limit of apikey or the server limit when it is not set
+func (h *Server) maxBodySize(key string) int64 {
+	if apiKey, _ := h.apiKey(key); apiKey.MaxBodySize > 0 {
+		return apiKey.MaxBodySize
+	}
+	return h.Config.MaxBodySize
 }
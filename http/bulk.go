@@ -0,0 +1,282 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk"
+)
+
+const bulkAction = "_bulk"
+
+// bulkActionMeta is a metadata of action line in Elasticsearch bulk request
+type bulkActionMeta struct {
+	Index string `json:"_index"`
+	Type  string `json:"_type"`
+}
+
+// bulkResponse is an Elasticsearch-compatible response for bulk request
+type bulkResponse struct {
+	Took   int64                          `json:"took"`
+	Errors bool                           `json:"errors"`
+	Items  []map[string]*bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string             `json:"_index"`
+	Type   string             `json:"_type"`
+	Result string             `json:"result,omitempty"`
+	Status int                `json:"status"`
+	Error  *bulkResponseError `json:"error,omitempty"`
+}
+
+type bulkResponseError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (h *Server) handleBulkRequest(w http.ResponseWriter, r *http.Request, defaultIndex, defaultType string) {
+	defer r.Body.Close()
+	start := time.Now()
+
+	statusCode, response, err := h.bulkPipe(r, defaultIndex, defaultType)
+
+	t := h.observeResponse(statusCode, start)
+	if err != nil {
+		setRetryAfter(w, err)
+		http.Error(w, err.Error(), statusCode)
+		h.Log.Warn("status", statusCode, "action", bulkAction, "msg", "JSON processing pipeline failed", "error", err)
+		return
+	}
+	response.Took = int64(t)
+	h.Log.Debug("status", statusCode, "action", bulkAction, "items", len(response.Items), "errors", response.Errors, "duration", t)
+	h.writeJSON(w, statusCode, response)
+}
+
+func (h *Server) bulkPipe(r *http.Request, defaultIndex, defaultType string) (statusCode int, response *bulkResponse, err error) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		statusCode = http.StatusMethodNotAllowed
+		err = fmt.Errorf("only POST method supported")
+		return
+	}
+
+	var key string
+	if key, statusCode, err = h.authenticateRequest(r); err != nil {
+		return
+	}
+	if statusCode, err = h.limitRequest(key); err != nil {
+		return
+	}
+
+	var body *requestBody
+	if body, statusCode, err = h.openBody(r, h.maxBodySize(key)); err != nil {
+		return
+	}
+	defer h.closeBody(body)
+
+	var decodedMessages []*elkstreams.LogMessage
+	if decodedMessages, response, err = h.decodeBulk(key, defaultIndex, defaultType, body); err != nil {
+		statusCode = http.StatusBadRequest
+		if err == errBodyTooLarge {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		return
+	}
+	rejected := make(map[string]int)
+	for _, item := range response.Items {
+		for _, i := range item {
+			if i.Error != nil {
+				rejected[i.Index]++
+			}
+		}
+	}
+	h.observeIngest(key, decodedMessages, rejected)
+	decoded := append([]*elkstreams.LogMessage(nil), decodedMessages...)
+	if decodedMessages, err = h.process(h.newProcessContext(r, key, start), decodedMessages); err != nil {
+		statusCode = http.StatusInternalServerError
+		return
+	}
+	markDropped(response, decoded, decodedMessages)
+	if statusCode, err = h.limitEvents(key, decodedMessages); err != nil {
+		return
+	}
+
+	if len(decodedMessages) > 0 {
+		if err = h.Publisher.Publish(decodedMessages); err != nil {
+			statusCode = publishStatusCode(err)
+			return
+		}
+	}
+
+	statusCode = http.StatusOK
+	return
+}
+
+// markDropped reports items of events dropped by processors as noop,
+// items without error are in the same order as decoded events
+func markDropped(response *bulkResponse, decoded, kept []*elkstreams.LogMessage) {
+	if len(decoded) == len(kept) {
+		return
+	}
+	processed := make(map[*elkstreams.LogMessage]struct{}, len(kept))
+	for _, message := range kept {
+		processed[message] = struct{}{}
+	}
+	i := 0
+	for _, actionItem := range response.Items {
+		for _, item := range actionItem {
+			if item.Error != nil {
+				continue
+			}
+			if _, ok := processed[decoded[i]]; !ok {
+				item.Status = http.StatusOK
+				item.Result = "noop"
+			}
+			i++
+		}
+	}
+}
+
+// decodeBulk parses action and source lines of Elasticsearch bulk request,
+// only index and create actions are supported
+func (h *Server) decodeBulk(key, defaultIndex, defaultType string, body io.Reader) ([]*elkstreams.LogMessage, *bulkResponse, error) {
+	var (
+		bulk      []*elkstreams.LogMessage
+		response  = &bulkResponse{Items: []map[string]*bulkResponseItem{}}
+		forbidden = make(map[string]error)
+		action    string
+		item      *bulkResponseItem
+		hasSource bool
+	)
+
+	checkIndex := func(index string) error {
+		err, checked := forbidden[index]
+		if !checked {
+			_, err = h.checkIndex(key, index)
+			forbidden[index] = err
+		}
+		return err
+	}
+
+	addItem := func(action string, item *bulkResponseItem) {
+		if item.Error != nil {
+			response.Errors = true
+		}
+		response.Items = append(response.Items, map[string]*bulkResponseItem{action: item})
+	}
+
+	err := readLines(body, func(line []byte) error {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+		if hasSource {
+			hasSource = false
+			if item.Error != nil {
+				addItem(action, item)
+				return nil
+			}
+			message, timestamp, err := h.checkMessage(line)
+			if err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = &bulkResponseError{Type: "parse_exception", Reason: err.Error()}
+				addItem(action, item)
+				return nil
+			}
+			if h.indexSuffix(item.Index) != "" {
+				item.Index = h.routeIndex(item.Index, timestamp)
+				if err := checkIndex(item.Index); err != nil {
+					item.Status = http.StatusForbidden
+					item.Error = &bulkResponseError{Type: "security_exception", Reason: err.Error()}
+					addItem(action, item)
+					return nil
+				}
+			}
+			l := make([]byte, len(message))
+			copy(l, message)
+			bulk = append(bulk, &elkstreams.LogMessage{
+				IndexName: item.Index,
+				IndexType: item.Type,
+				Body:      l,
+			})
+			item.Status = http.StatusCreated
+			item.Result = "created"
+			addItem(action, item)
+			return nil
+		}
+
+		var actionLine map[string]bulkActionMeta
+		if err := json.Unmarshal(line, &actionLine); err != nil || len(actionLine) != 1 {
+			return fmt.Errorf("malformed action/metadata line, expected a single action object")
+		}
+		var meta bulkActionMeta
+		for name, m := range actionLine {
+			action, meta = name, m
+		}
+
+		item = &bulkResponseItem{
+			Index: strings.ToLower(meta.Index),
+			Type:  meta.Type,
+		}
+		if item.Index == "" {
+			item.Index = defaultIndex
+		}
+		if item.Type == "" {
+			item.Type = defaultType
+		}
+		if item.Type == "" {
+			item.Type = DefaultType
+		}
+
+		switch action {
+		case "index", "create":
+			hasSource = true
+		case "update":
+			hasSource = true
+			item.Status = http.StatusBadRequest
+			item.Error = &bulkResponseError{Type: "illegal_argument_exception", Reason: "action [update] is not supported"}
+			return nil
+		case "delete":
+			item.Status = http.StatusBadRequest
+			item.Error = &bulkResponseError{Type: "illegal_argument_exception", Reason: "action [delete] is not supported"}
+			addItem(action, item)
+			return nil
+		default:
+			return fmt.Errorf("unknown bulk action [%s]", action)
+		}
+
+		if item.Index == "" {
+			item.Status = http.StatusBadRequest
+			item.Error = &bulkResponseError{Type: "action_request_validation_exception", Reason: "index is missing"}
+			return nil
+		}
+		// routed index is checked when its date suffix is known from the source
+		var err error
+		if h.indexSuffix(item.Index) == "" {
+			err = checkIndex(item.Index)
+		}
+		if err == nil {
+			_, err = h.checkType(key, item.Type)
+		}
+		if err != nil {
+			item.Status = http.StatusForbidden
+			item.Error = &bulkResponseError{Type: "security_exception", Reason: err.Error()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasSource {
+		return nil, nil, fmt.Errorf("the bulk request must be terminated by a source line")
+	}
+	if len(response.Items) < 1 {
+		return nil, nil, fmt.Errorf("request body is required")
+	}
+	return bulk, response, nil
+}
@@ -2,8 +2,46 @@ package http
 
 // Config settings
 type Config struct {
-	Address     string              `yaml:"address"`
-	APIKeys     map[string][]string `yaml:"api_keys"`
-	Timeout     int64               `yaml:"timeout"`
-	IdleTimeout int64               `yaml:"idle_timeout"`
+	Address               string               `yaml:"address"`
+	APIKeys               map[string]APIKey    `yaml:"api_keys"`
+	APIKeysFile           string               `yaml:"api_keys_file"`
+	APIKeysReloadInterval int64                `yaml:"api_keys_reload_interval"`
+	Timeout               int64                `yaml:"timeout"`
+	IdleTimeout           int64                `yaml:"idle_timeout"`
+	AsyncQueueSize        int                  `yaml:"async_queue_size"`
+	AsyncWorkers          int                  `yaml:"async_workers"`
+	MaxBodySize           int64                `yaml:"max_body_size"`
+	MetricsMaxLabels      int                  `yaml:"metrics_max_labels"`
+	RateLimits            map[string]RateLimit `yaml:"rate_limits"`
+	TLS                   TLSConfig            `yaml:"tls"`
+	Processors            []ProcessorConfig    `yaml:"processors"`
+	TimestampMaxFuture    int64                `yaml:"timestamp_max_future"`
+	TimestampMaxPast      int64                `yaml:"timestamp_max_past"`
+	IndexRouting          []IndexRoutingConfig `yaml:"index_routing"`
+}
+
+// TLSConfig settings of HTTPS listener, client certificates are verified by client CA if it is set
+// and CN or SAN of certificate is used instead of apikey when Authorization header is not sent
+type TLSConfig struct {
+	Enabled           bool              `yaml:"enabled"`
+	CertFile          string            `yaml:"cert_file"`
+	KeyFile           string            `yaml:"key_file"`
+	MinVersion        string            `yaml:"min_version"`
+	CipherSuites      []string          `yaml:"cipher_suites"`
+	ClientCAFile      string            `yaml:"client_ca_file"`
+	RequireClientCert bool              `yaml:"require_client_cert"`
+	ClientCerts       map[string]APIKey `yaml:"client_certs"`
+}
+
+// RateLimit is limits of owner of apikeys shared by all its apikeys, limits are keyed by owner,
+// name of hashed apikey or project part of plain apikey, zero value means unlimited,
+// burst is a bucket capacity and equals to per second rate by default
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	RequestsBurst     float64 `yaml:"requests_burst"`
+	EventsPerSecond   float64 `yaml:"events_per_second"`
+	EventsBurst       float64 `yaml:"events_burst"`
+	BytesPerSecond    float64 `yaml:"bytes_per_second"`
+	BytesBurst        float64 `yaml:"bytes_burst"`
+	DailyEvents       int64   `yaml:"daily_events"`
 }
@@ -6,17 +6,81 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/AlexAkulov/candy-elk"
 )
 
+// maxReportedLines limits the number of rejected lines listed in ingestion report
+const maxReportedLines = 1000
+
+// rejectedLine describes a line which was not accepted
+type rejectedLine struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// ingestReport is a per-line result of request processing
+type ingestReport struct {
+	Accepted      int            `json:"accepted"`
+	Rejected      int            `json:"rejected"`
+	RejectedLines []rejectedLine `json:"rejected_lines"`
+	Error         string         `json:"error,omitempty"`
+}
+
 func (h *Server) decodeMessages(indexName string, indexType string, body io.Reader) ([]*elkstreams.LogMessage, error) {
+	bulk, _, err := h.decodeMessagesWithReport(indexName, indexType, body, false)
+	return bulk, err
+}
+
+// decodeMessagesWithReport decodes body and returned accepted messages and report about rejected lines,
+// in strict mode the bulk is rejected if it contains at least one bad line
+func (h *Server) decodeMessagesWithReport(indexName string, indexType string, body io.Reader, strict bool) ([]*elkstreams.LogMessage, *ingestReport, error) {
 	var (
 		bulk       []*elkstreams.LogMessage
-		badLines   int
 		totalLines int
+		report     = &ingestReport{RejectedLines: []rejectedLine{}}
 	)
 
+	err := readLines(body, func(line []byte) error {
+		totalLines++
+		message, timestamp, err := h.checkMessage(line)
+		if err != nil {
+			h.Log.Debug("msg", err, "body", string(line))
+			report.Rejected++
+			if len(report.RejectedLines) < maxReportedLines {
+				report.RejectedLines = append(report.RejectedLines, rejectedLine{Line: totalLines, Reason: err.Error()})
+			}
+			return nil
+		}
+		l := make([]byte, len(message))
+		copy(l, message)
+
+		bulk = append(bulk, &elkstreams.LogMessage{
+			IndexName: h.routeIndex(indexName, timestamp),
+			IndexType: indexType,
+			Body:      l,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Accepted = len(bulk)
+	if len(bulk) < 1 {
+		return nil, report, fmt.Errorf("bad request. %d of %d lines is bad", report.Rejected, totalLines)
+	}
+	if report.Rejected > 0 {
+		if strict {
+			return nil, report, fmt.Errorf("bad request. %d of %d lines is bad, strict mode is on", report.Rejected, totalLines)
+		}
+		h.Log.Warn("index", indexName, "type", indexType, "msg", "bulk contains bad lines", "bad_count", report.Rejected, "total_count", totalLines)
+	}
+	return bulk, report, nil
+}
+
+// readLines calls fn for each line of body, the line is valid only until fn returns
+func readLines(body io.Reader, fn func(line []byte) error) error {
 	bodyReader := bufio.NewReader(body)
 	var line bytes.Buffer
 	for {
@@ -24,47 +88,85 @@ func (h *Server) decodeMessages(indexName string, indexType string, body io.Read
 		if err == nil {
 			line.Write(part)
 			if !isPrefix {
-				totalLines++
-				if err := h.checkMessage(line.Bytes()); err != nil {
-					h.Log.Debug("msg", err, "body", string(line.Bytes()))
-					badLines++
-				} else {
-					l := make([]byte, line.Len())
-					copy(l, line.Bytes())
-
-					bulk = append(bulk, &elkstreams.LogMessage{
-						IndexName: indexName,
-						IndexType: indexType,
-						Body:      l,
-					})
+				if err := fn(line.Bytes()); err != nil {
+					return err
 				}
 				line.Reset()
 			}
 			continue
 		}
+		if err == errBodyTooLarge {
+			return err
+		}
 		if err != io.EOF {
-			return nil, fmt.Errorf("can't read body: %s", err)
+			return fmt.Errorf("can't read body: %s", err)
 		}
-		break
-	}
-	if len(bulk) < 1 {
-		return nil, fmt.Errorf("bad request. %d of %d lines is bad", badLines, totalLines)
+		return nil
 	}
-	if badLines > 0 {
-		h.Log.Warn("index", indexName, "type", indexType, "msg", "bulk contains bad lines", "bad_count", badLines, "total_count", totalLines)
-	}
-	return bulk, nil
 }
 
-func (h *Server) checkMessage(message []byte) error {
-	var decodedMessage map[string]interface{}
+// checkMessage validates message and returned it with @timestamp normalized to RFC3339 UTC and parsed @timestamp,
+// only the value of @timestamp is replaced and the rest of message is returned as is
+func (h *Server) checkMessage(message []byte) ([]byte, time.Time, error) {
+	var decodedMessage map[string]json.RawMessage
 	if err := json.Unmarshal(message, &decodedMessage); err != nil {
-		return fmt.Errorf("cannot unmarshal json")
+		return nil, time.Time{}, fmt.Errorf("cannot unmarshal json")
 	}
 
-	if _, ok := decodedMessage["@timestamp"]; !ok {
-		return fmt.Errorf("@timestamp field doesn't exist")
+	raw, ok := decodedMessage[timestampField]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("@timestamp field doesn't exist")
+	}
+	timestamp, normalized, err := parseTimestamp(raw)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := h.checkTimestamp(timestamp, time.Now()); err != nil {
+		return nil, time.Time{}, err
+	}
+	if normalized {
+		return message, timestamp, nil
 	}
 
-	return nil
+	value, err := json.Marshal(timestamp.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	start, end, err := timestampOffsets(message)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	result := make([]byte, 0, len(message)-(end-start)+len(value))
+	result = append(result, message[:start]...)
+	result = append(result, value...)
+	result = append(result, message[end:]...)
+	return result, timestamp, nil
+}
+
+// timestampOffsets returned start and end offsets of raw value of @timestamp in message,
+// the last one is used when the field is repeated like json.Unmarshal does
+func timestampOffsets(message []byte) (int, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	if _, err := decoder.Token(); err != nil {
+		return 0, 0, fmt.Errorf("cannot unmarshal json")
+	}
+	start, end := -1, -1
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot unmarshal json")
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return 0, 0, fmt.Errorf("cannot unmarshal json")
+		}
+		if key == timestampField {
+			end = int(decoder.InputOffset())
+			start = end - len(value)
+		}
+	}
+	if start < 0 {
+		return 0, 0, fmt.Errorf("@timestamp field doesn't exist")
+	}
+	return start, end, nil
 }
@@ -0,0 +1,127 @@
+package http
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var errBodyTooLarge = fmt.Errorf("request body is too large")
+
+// countingReader counts bytes read from underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader returns errBodyTooLarge when more than limit bytes are read
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.limit+1 {
+		p = p[0 : l.limit+1]
+	}
+	n, err := l.r.Read(p)
+	l.limit -= int64(n)
+	if l.limit < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// requestBody is a decompressed request body
+type requestBody struct {
+	io.Reader
+	compressed   *countingReader
+	decompressed *countingReader
+	close        func()
+}
+
+// closeBody releases decoder and updates byte counters
+func (h *Server) closeBody(body *requestBody) {
+	if body.close != nil {
+		body.close()
+	}
+	h.metrics.bytesReceived.Add(float64(body.compressed.n))
+	h.metrics.bytesDecompressed.Add(float64(body.decompressed.n))
+}
+
+// zstdMaxWindowSize limits memory of zstd decoder, frames with larger window are rejected,
+// WithDecoderMaxMemory caps window size of streaming decoder and total size is limited by max body size
+const zstdMaxWindowSize = 8 << 20
+
+// openBody returned request body decoded according to Content-Encoding header and limited by maxBodySize
+func (h *Server) openBody(r *http.Request, maxBodySize int64) (*requestBody, int, error) {
+	body := &requestBody{
+		compressed: &countingReader{r: r.Body},
+	}
+
+	var decoded io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		decoded = body.compressed
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body.compressed)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("can't decode gzip body: %s", err)
+		}
+		body.close = func() { gz.Close() }
+		decoded = gz
+	case "deflate":
+		fr, err := newDeflateReader(body.compressed)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("can't decode deflate body: %s", err)
+		}
+		body.close = func() { fr.Close() }
+		decoded = fr
+	case "zstd":
+		zr, err := zstd.NewReader(body.compressed,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(zstdMaxWindowSize),
+		)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("can't decode zstd body: %s", err)
+		}
+		body.close = zr.Close
+		decoded = zr
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content encoding '%s' is not supported, only gzip, deflate and zstd are allowed", encoding)
+	}
+
+	if maxBodySize > 0 {
+		decoded = &limitedReader{r: decoded, limit: maxBodySize}
+	}
+	body.decompressed = &countingReader{r: decoded}
+	body.Reader = body.decompressed
+	return body, 0, nil
+}
+
+// newDeflateReader accepts both zlib-wrapped (RFC 1950) and raw (RFC 1951) deflate streams
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
@@ -0,0 +1,295 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	hashSHA256Prefix = "sha256:"
+	// failedKeyTTL is a time while secret failed bcrypt verification is rejected without checking
+	failedKeyTTL = 10 * time.Second
+	// failedKeysLimit is a size of failed secrets cache, the cache is cleared when it is full
+	failedKeysLimit = 10000
+)
+
+// HashAPIKey returned salted SHA-256 hash of apikey in the form sha256:<salt>:<hex digest>
+func HashAPIKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashSHA256(hex.EncodeToString(salt), key), nil
+}
+
+func hashSHA256(salt, key string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hashSHA256Prefix + salt + ":" + hex.EncodeToString(sum[:])
+}
+
+// checkHash checks that hash has sha256 or bcrypt format
+func checkHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, hashSHA256Prefix):
+		parts := strings.Split(hash, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("bad sha256 hash, expected sha256:<salt>:<hex digest>")
+		}
+		if digest, err := hex.DecodeString(parts[2]); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("bad sha256 hash, digest must be %d bytes in hex", sha256.Size)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	}
+	return fmt.Errorf("unknown hash format, expected sha256:<salt>:<hex digest> or bcrypt")
+}
+
+// verify checks secret against apikey, plain keys are the names of apikeys and compared in constant time
+func (k APIKey) verify(name, secret string) bool {
+	switch {
+	case k.Hash == "":
+		return subtle.ConstantTimeCompare([]byte(name), []byte(secret)) == 1
+	case strings.HasPrefix(k.Hash, hashSHA256Prefix):
+		parts := strings.Split(k.Hash, ":")
+		if len(parts) != 3 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hashSHA256(parts[1], secret)), []byte(k.Hash)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(secret)) == nil
+	}
+}
+
+// verifiedKey is a cached result of secret verification, it is valid while hash of apikey is not changed
+type verifiedKey struct {
+	name string
+	hash string
+}
+
+// keyStore keeps apikeys loaded from api_keys_file and cache of verified secrets
+type keyStore struct {
+	mu       sync.RWMutex
+	path     string
+	modTimes map[string]time.Time
+	keys     map[string]APIKey
+	verified map[[sha256.Size]byte]verifiedKey
+	failed   map[[sha256.Size]byte]time.Time
+}
+
+// apiKey returned apikey by name, keys from api_keys_file override keys from main config
+func (h *Server) apiKey(name string) (APIKey, bool) {
+	if strings.HasPrefix(name, clientCertKeyPrefix) {
+		return h.clientCertKey(name)
+	}
+	h.keys.mu.RLock()
+	apiKey, ok := h.keys.keys[name]
+	h.keys.mu.RUnlock()
+	if ok {
+		return apiKey, true
+	}
+	apiKey, ok = h.Config.APIKeys[name]
+	return apiKey, ok
+}
+
+// findAPIKey returned name and settings of apikey matched the secret.
+// bcrypt is slow so only one bcrypt key is checked: the secret must start with its name and '-',
+// verified secrets are cached by their SHA-256 and failed ones are rejected for failedKeyTTL
+func (h *Server) findAPIKey(secret string) (string, APIKey, bool) {
+	digest := sha256.Sum256([]byte(secret))
+	now := time.Now()
+	h.keys.mu.RLock()
+	cached, ok := h.keys.verified[digest]
+	failedAt, failed := h.keys.failed[digest]
+	h.keys.mu.RUnlock()
+	if ok {
+		if apiKey, exists := h.apiKey(cached.name); exists && apiKey.Hash == cached.hash {
+			return cached.name, apiKey, true
+		}
+	}
+	if failed && now.Sub(failedAt) < failedKeyTTL {
+		return "", APIKey{}, false
+	}
+
+	var (
+		found  string
+		slow   string
+		names  = h.apiKeyNames()
+		result APIKey
+	)
+	for _, name := range names {
+		apiKey, _ := h.apiKey(name)
+		if apiKey.Hash != "" && !strings.HasPrefix(apiKey.Hash, hashSHA256Prefix) {
+			// the longest name is selected when names of several keys are prefixes of the secret
+			if strings.HasPrefix(secret, name+"-") && len(name) > len(slow) {
+				slow = name
+			}
+			continue
+		}
+		// all cheap keys are checked to not leak which of them was matched
+		if apiKey.verify(name, secret) && found == "" {
+			found, result = name, apiKey
+		}
+	}
+	if found == "" && slow != "" {
+		if apiKey, _ := h.apiKey(slow); apiKey.verify(slow, secret) {
+			found, result = slow, apiKey
+		} else {
+			h.addFailedKey(digest, now)
+		}
+	}
+	if found == "" {
+		return "", APIKey{}, false
+	}
+
+	h.keys.mu.Lock()
+	if h.keys.verified == nil {
+		h.keys.verified = make(map[[sha256.Size]byte]verifiedKey)
+	}
+	h.keys.verified[digest] = verifiedKey{name: found, hash: result.Hash}
+	h.keys.mu.Unlock()
+	return found, result, true
+}
+
+// addFailedKey remembers secret failed bcrypt verification
+func (h *Server) addFailedKey(digest [sha256.Size]byte, now time.Time) {
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+	if h.keys.failed == nil || len(h.keys.failed) >= failedKeysLimit {
+		h.keys.failed = make(map[[sha256.Size]byte]time.Time)
+	}
+	h.keys.failed[digest] = now
+}
+
+// apiKeyNames returned names of apikeys from main config and api_keys_file
+func (h *Server) apiKeyNames() []string {
+	names := make([]string, 0, len(h.Config.APIKeys))
+	for name := range h.Config.APIKeys {
+		names = append(names, name)
+	}
+	h.keys.mu.RLock()
+	for name := range h.keys.keys {
+		if _, ok := h.Config.APIKeys[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	h.keys.mu.RUnlock()
+	return names
+}
+
+// apiKeyFiles returned api_keys_file or YAML and JSON files from api_keys_file directory
+func apiKeyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// reloadKeyFiles loads api_keys_file if it or any file in the directory was changed,
+// it returned true when keys were reloaded
+func (h *Server) reloadKeyFiles() (bool, error) {
+	path := h.Config.APIKeysFile
+	if path == "" {
+		h.keys.mu.Lock()
+		defer h.keys.mu.Unlock()
+		changed := h.keys.path != ""
+		h.keys.path, h.keys.modTimes, h.keys.keys, h.keys.verified, h.keys.failed = "", nil, nil, nil, nil
+		return changed, nil
+	}
+
+	files, err := apiKeyFiles(path)
+	if err != nil {
+		return false, fmt.Errorf("can't read api_keys_file: %v", err)
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("can't read api_keys_file: %v", err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+	h.keys.mu.RLock()
+	changed := path != h.keys.path || len(modTimes) != len(h.keys.modTimes)
+	for file, modTime := range modTimes {
+		if !h.keys.modTimes[file].Equal(modTime) {
+			changed = true
+		}
+	}
+	h.keys.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	keys := make(map[string]APIKey)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, fmt.Errorf("can't read api_keys_file: %v", err)
+		}
+		var fileKeys map[string]APIKey
+		if err := yaml.Unmarshal(data, &fileKeys); err != nil {
+			return false, fmt.Errorf("can't parse api keys file %s: %v", file, err)
+		}
+		for name, apiKey := range fileKeys {
+			keys[name] = apiKey
+		}
+	}
+
+	h.keys.mu.Lock()
+	h.keys.path, h.keys.modTimes, h.keys.keys, h.keys.verified, h.keys.failed = path, modTimes, keys, nil, nil
+	h.keys.mu.Unlock()
+	return true, nil
+}
+
+// watchKeyFiles polls api_keys_file for changes until server is stopped
+func (h *Server) watchKeyFiles() error {
+	interval := time.Duration(h.Config.APIKeysReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.tomb.Dying():
+			return nil
+		case <-ticker.C:
+			reloaded, err := h.reloadKeyFiles()
+			if err != nil {
+				h.Log.Error("msg", "can't reload api keys, previous keys are used", "err", err)
+				continue
+			}
+			if reloaded {
+				h.Log.Info("msg", "api keys were reloaded", "path", h.Config.APIKeysFile)
+			}
+		}
+	}
+}
@@ -2,8 +2,8 @@ package http
 
 import (
 	"fmt"
-	"strings"
 	"path"
+	"strings"
 )
 
 // ReadPath returned index and type from location
@@ -24,3 +24,31 @@ func (h *Server) readPath(location string) (string, string, error) {
 		return "", "", fmt.Errorf("path %s must be in the form /logs/<index>/[type]", location)
 	}
 }
+
+// isAsyncPath returned true if location is an async-logs action
+func (h *Server) isAsyncPath(location string) bool {
+	p := strings.Trim(path.Clean(location), "/")
+	return strings.Split(p, "/")[0] == "async-logs"
+}
+
+// readBulkPath returned default index and type from Elasticsearch bulk API location
+// such as /_bulk, /<index>/_bulk or /<index>/<type>/_bulk
+func (h *Server) readBulkPath(location string) (string, string, bool) {
+	p := strings.Trim(path.Clean(location), "/")
+	parts := strings.Split(p, "/")
+
+	if parts[len(parts)-1] != bulkAction {
+		return "", "", false
+	}
+
+	switch len(parts) {
+	case 1:
+		return "", "", true
+	case 2:
+		return strings.ToLower(parts[0]), "", true
+	case 3:
+		return strings.ToLower(parts[0]), parts[1], true
+	default:
+		return "", "", false
+	}
+}
@@ -0,0 +1,250 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk"
+)
+
+// ProcessorConfig is a set of changes applied to events of indices matched any of index patterns,
+// drop conditions are checked on original event and then fields are renamed, removed and added,
+// all fields are renamed at once, so a->b and b->c moves a to b and b to c,
+// if several fields are renamed to the same one, the value of the last field in sorted order is kept
+type ProcessorConfig struct {
+	Indices            []string          `yaml:"indices"`
+	Drop               []DropCondition   `yaml:"drop"`
+	RenameFields       map[string]string `yaml:"rename_fields"`
+	RemoveFields       []string          `yaml:"remove_fields"`
+	AddFields          map[string]string `yaml:"add_fields"`
+	ReceivedAtField    string            `yaml:"received_at_field"`
+	ClientAddressField string            `yaml:"client_address_field"`
+	ProjectField       string            `yaml:"project_field"`
+	HostnameField      string            `yaml:"hostname_field"`
+}
+
+// DropCondition matches event when all of its set checks of the field are passed
+type DropCondition struct {
+	Field  string  `yaml:"field"`
+	Equals *string `yaml:"equals"`
+	Regex  string  `yaml:"regex"`
+	Exists *bool   `yaml:"exists"`
+}
+
+type dropCondition struct {
+	DropCondition
+	regex *regexp.Regexp
+}
+
+type processor struct {
+	ProcessorConfig
+	drop       []dropCondition
+	renameFrom []string
+}
+
+// processors keeps compiled processors, they are replaced on reload
+type processors struct {
+	mu       sync.RWMutex
+	list     []*processor
+	hostname string
+}
+
+// processContext is a request information stamped to events
+type processContext struct {
+	receivedAt    time.Time
+	clientAddress string
+	project       string
+}
+
+func compileProcessors(configs []ProcessorConfig) ([]*processor, error) {
+	result := make([]*processor, 0, len(configs))
+	for i, config := range configs {
+		if len(config.Indices) == 0 {
+			return nil, fmt.Errorf("processor %d: indices are required", i)
+		}
+		for _, pattern := range config.Indices {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("processor %d: bad index pattern '%s': %v", i, pattern, err)
+			}
+		}
+		p := &processor{ProcessorConfig: config}
+		for _, condition := range config.Drop {
+			if condition.Field == "" {
+				return nil, fmt.Errorf("processor %d: field of drop condition is required", i)
+			}
+			if condition.Equals == nil && condition.Regex == "" && condition.Exists == nil {
+				return nil, fmt.Errorf("processor %d: drop condition of field '%s' has no checks", i, condition.Field)
+			}
+			c := dropCondition{DropCondition: condition}
+			if condition.Regex != "" {
+				var err error
+				if c.regex, err = regexp.Compile(condition.Regex); err != nil {
+					return nil, fmt.Errorf("processor %d: bad regex of field '%s': %v", i, condition.Field, err)
+				}
+			}
+			p.drop = append(p.drop, c)
+		}
+		for from := range config.RenameFields {
+			p.renameFrom = append(p.renameFrom, from)
+		}
+		sort.Strings(p.renameFrom)
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// ReloadProcessors compiles processors from config, previous processors are kept on error
+func (h *Server) ReloadProcessors() error {
+	list, err := compileProcessors(h.Config.Processors)
+	if err != nil {
+		return err
+	}
+	h.processors.mu.Lock()
+	h.processors.list = list
+	if h.processors.hostname == "" {
+		h.processors.hostname, _ = os.Hostname()
+	}
+	h.processors.mu.Unlock()
+	return nil
+}
+
+// newProcessContext returned request information for processors
+func (h *Server) newProcessContext(r *http.Request, key string, receivedAt time.Time) *processContext {
+	clientAddress, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientAddress = r.RemoteAddr
+	}
+	apiKey, _ := h.apiKey(key)
+	return &processContext{
+		receivedAt:    receivedAt,
+		clientAddress: clientAddress,
+		project:       apiKey.OwnerName(key),
+	}
+}
+
+// process applies processors to messages and returned messages which were not dropped
+func (h *Server) process(ctx *processContext, messages []*elkstreams.LogMessage) ([]*elkstreams.LogMessage, error) {
+	h.processors.mu.RLock()
+	list, hostname := h.processors.list, h.processors.hostname
+	h.processors.mu.RUnlock()
+	if len(list) == 0 {
+		return messages, nil
+	}
+
+	result := messages[:0]
+	for _, message := range messages {
+		var matched []*processor
+		for _, p := range list {
+			if p.match(message.IndexName) {
+				matched = append(matched, p)
+			}
+		}
+		if len(matched) == 0 {
+			result = append(result, message)
+			continue
+		}
+
+		event := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(message.Body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&event); err != nil {
+			return nil, fmt.Errorf("can't decode event: %v", err)
+		}
+		dropped := false
+		for _, p := range matched {
+			if dropped = p.apply(event, ctx, hostname); dropped {
+				break
+			}
+		}
+		if dropped {
+			h.metrics.dropped.Add(1)
+			continue
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode event: %v", err)
+		}
+		message.Body = body
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+func (p *processor) match(index string) bool {
+	for _, pattern := range p.Indices {
+		if matched, _ := filepath.Match(pattern, index); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes event and returned true if event should be dropped
+func (p *processor) apply(event map[string]interface{}, ctx *processContext, hostname string) bool {
+	for _, condition := range p.drop {
+		if condition.match(event) {
+			return true
+		}
+	}
+	renamed := make(map[string]interface{}, len(p.renameFrom))
+	for _, from := range p.renameFrom {
+		if value, ok := event[from]; ok {
+			delete(event, from)
+			renamed[from] = value
+		}
+	}
+	for _, from := range p.renameFrom {
+		if value, ok := renamed[from]; ok {
+			event[p.RenameFields[from]] = value
+		}
+	}
+	for _, field := range p.RemoveFields {
+		delete(event, field)
+	}
+	for field, value := range p.AddFields {
+		event[field] = value
+	}
+	if p.ReceivedAtField != "" {
+		event[p.ReceivedAtField] = ctx.receivedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if p.ClientAddressField != "" {
+		event[p.ClientAddressField] = ctx.clientAddress
+	}
+	if p.ProjectField != "" {
+		event[p.ProjectField] = ctx.project
+	}
+	if p.HostnameField != "" {
+		event[p.HostnameField] = hostname
+	}
+	return false
+}
+
+func (c *dropCondition) match(event map[string]interface{}) bool {
+	value, exists := event[c.Field]
+	if c.Exists != nil && *c.Exists != exists {
+		return false
+	}
+	if c.Equals == nil && c.regex == nil {
+		return c.Exists != nil
+	}
+	if !exists {
+		return false
+	}
+	s := fmt.Sprint(value)
+	if c.Equals != nil && s != *c.Equals {
+		return false
+	}
+	if c.regex != nil && !c.regex.MatchString(s) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk"
+)
+
+// DefaultRateLimitKey is a key of rate limits applied to owners of apikeys without own limits
+const DefaultRateLimitKey = "*"
+
+// rateLimitError is returned when apikey exceeded its rate limit or daily quota
+type rateLimitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return e.reason
+}
+
+// setRetryAfter sets Retry-After header in seconds if err is a rate limit error
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if e, ok := err.(*rateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+	}
+}
+
+// tokenBucket is refilled with rate tokens per second up to burst tokens,
+// a request larger than burst is allowed on full bucket and leaves the bucket in debt
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// wait refills the bucket and returned zero if n tokens are available or the time to wait until they are
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if need := math.Min(n, b.burst); b.tokens < need {
+		return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	}
+	return 0
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// keyLimiter is a state of rate limits of one owner of apikeys
+type keyLimiter struct {
+	config    RateLimit
+	requests  *tokenBucket
+	events    *tokenBucket
+	bytes     *tokenBucket
+	day       string
+	dayEvents int64
+}
+
+func newKeyLimiter(config RateLimit, now time.Time) *keyLimiter {
+	l := &keyLimiter{config: config}
+	if config.RequestsPerSecond > 0 {
+		l.requests = newTokenBucket(config.RequestsPerSecond, config.RequestsBurst, now)
+	}
+	if config.EventsPerSecond > 0 {
+		l.events = newTokenBucket(config.EventsPerSecond, config.EventsBurst, now)
+	}
+	if config.BytesPerSecond > 0 {
+		l.bytes = newTokenBucket(config.BytesPerSecond, config.BytesBurst, now)
+	}
+	return l
+}
+
+// rateLimiter keeps limiters of owners, limiter is recreated when its config was reloaded
+type rateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*keyLimiter
+}
+
+func (r *rateLimiter) limiter(owner string, config RateLimit, now time.Time) *keyLimiter {
+	if r.limiters == nil {
+		r.limiters = make(map[string]*keyLimiter)
+	}
+	l, ok := r.limiters[owner]
+	if !ok || l.config != config {
+		prev := l
+		l = newKeyLimiter(config, now)
+		if prev != nil {
+			l.day, l.dayEvents = prev.day, prev.dayEvents
+		}
+		r.limiters[owner] = l
+	}
+	return l
+}
+
+// rateLimit returned owner of apikey and limits of the owner, limits are keyed by owner
+// and not by apikey name which is the secret itself for plain apikeys
+func (h *Server) rateLimit(key string) (string, RateLimit, bool) {
+	apiKey, _ := h.apiKey(key)
+	owner := apiKey.OwnerName(key)
+	if limit, ok := h.Config.RateLimits[owner]; ok {
+		return owner, limit, true
+	}
+	limit, ok := h.Config.RateLimits[DefaultRateLimitKey]
+	return owner, limit, ok
+}
+
+// limitRequest takes one request from limit of apikey owner
+func (h *Server) limitRequest(key string) (int, error) {
+	owner, config, ok := h.rateLimit(key)
+	if !ok {
+		return 0, nil
+	}
+	now := time.Now()
+	h.limits.mu.Lock()
+	defer h.limits.mu.Unlock()
+	l := h.limits.limiter(owner, config, now)
+	if wait := l.requests.wait(1, now); wait > 0 {
+		return http.StatusTooManyRequests, &rateLimitError{reason: "requests rate limit exceeded", retryAfter: wait}
+	}
+	l.requests.take(1)
+	return 0, nil
+}
+
+// limitEvents takes decoded messages and their bytes from limits and daily quota of apikey owner,
+// nothing is taken if any limit is exceeded
+func (h *Server) limitEvents(key string, messages []*elkstreams.LogMessage) (int, error) {
+	owner, config, ok := h.rateLimit(key)
+	if !ok || len(messages) == 0 {
+		return 0, nil
+	}
+	var size int
+	for _, message := range messages {
+		size += len(message.Body)
+	}
+	events := float64(len(messages))
+	now := time.Now()
+
+	h.limits.mu.Lock()
+	defer h.limits.mu.Unlock()
+	l := h.limits.limiter(owner, config, now)
+
+	utc := now.UTC()
+	if day := utc.Format("2006-01-02"); day != l.day {
+		l.day, l.dayEvents = day, 0
+	}
+	if config.DailyEvents > 0 && l.dayEvents+int64(len(messages)) > config.DailyEvents {
+		tomorrow := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		return http.StatusTooManyRequests, &rateLimitError{
+			reason:     fmt.Sprintf("daily quota of %d events exceeded", config.DailyEvents),
+			retryAfter: tomorrow.Sub(utc),
+		}
+	}
+
+	if wait := l.events.wait(events, now); wait > 0 {
+		return http.StatusTooManyRequests, &rateLimitError{reason: "events rate limit exceeded", retryAfter: wait}
+	}
+	if wait := l.bytes.wait(float64(size), now); wait > 0 {
+		return http.StatusTooManyRequests, &rateLimitError{reason: "bytes rate limit exceeded", retryAfter: wait}
+	}
+	l.events.take(events)
+	l.bytes.take(float64(size))
+	l.dayEvents += int64(len(messages))
+	return 0, nil
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// index suffix layouts of routed indices
+const (
+	SuffixDaily   = "daily"
+	SuffixWeekly  = "weekly"
+	SuffixMonthly = "monthly"
+)
+
+// IndexRoutingConfig routes events posted to base index matched any of patterns
+// to index with date suffix derived from @timestamp of each event
+type IndexRoutingConfig struct {
+	Indices []string `yaml:"indices"`
+	Suffix  string   `yaml:"suffix"`
+}
+
+// CheckIndexRouting returned error if suffix or index pattern of any routing config is not valid
+func CheckIndexRouting(configs []IndexRoutingConfig) error {
+	for i, config := range configs {
+		switch config.Suffix {
+		case SuffixDaily, SuffixWeekly, SuffixMonthly:
+		default:
+			return fmt.Errorf("index routing %d: unknown suffix '%s', expected %s, %s or %s", i, config.Suffix, SuffixDaily, SuffixWeekly, SuffixMonthly)
+		}
+		for _, pattern := range config.Indices {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("index routing %d: bad index pattern '%s': %v", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexSuffix returned suffix layout of base index or empty string if the index is not routed
+func (h *Server) indexSuffix(base string) string {
+	for _, config := range h.Config.IndexRouting {
+		for _, pattern := range config.Indices {
+			if matched, _ := filepath.Match(pattern, base); matched {
+				return config.Suffix
+			}
+		}
+	}
+	return ""
+}
+
+// routeIndex returned index name with date suffix like index-2006.01.02, index-2006.01 for monthly
+// or index-2006.w52 with ISO week for weekly routing, not routed index is returned as is
+func (h *Server) routeIndex(base string, timestamp time.Time) string {
+	t := timestamp.UTC()
+	switch h.indexSuffix(base) {
+	case SuffixDaily:
+		return base + t.Format("-2006.01.02")
+	case SuffixWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%s-%04d.w%02d", base, year, week)
+	case SuffixMonthly:
+		return base + t.Format("-2006.01")
+	}
+	return base
+}
+
+// checkIndices checks that all indices of routed messages are allowed for apikey
+func (h *Server) checkIndices(key string, indices map[string]struct{}) (int, error) {
+	for index := range indices {
+		if statusCode, err := h.checkIndex(key, index); err != nil {
+			return statusCode, err
+		}
+	}
+	return 0, nil
+}
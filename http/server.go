@@ -1,15 +1,19 @@
 package http
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"gopkg.in/tomb.v2"
 
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/helpers"
 )
 
 const (
@@ -24,20 +28,60 @@ type Server struct {
 	Log           elkstreams.Logger
 	MetricStorage elkstreams.MetricStorage
 	tomb          tomb.Tomb
+	queue         chan []*elkstreams.LogMessage
+	queueMu       sync.RWMutex // guards queueClosed
+	queueClosed   bool
+	limits        rateLimiter
+	tls           tlsState
+	processors    processors
+	keys          keyStore
 	metrics       struct {
-		response    map[string]elkstreams.MetricCounter
-		requestTime map[string]elkstreams.MetricHistogram
+		response          map[string]elkstreams.MetricCounter
+		requestTime       map[string]elkstreams.MetricHistogram
+		queueLength       elkstreams.MetricGauge
+		asyncErrors       elkstreams.MetricCounter
+		bytesReceived     elkstreams.MetricCounter
+		bytesDecompressed elkstreams.MetricCounter
+		byIndex           *helpers.LabeledCounters
+		byProject         *helpers.LabeledCounters
+		dropped           elkstreams.MetricCounter
 	}
 }
 
 // Start initializes HTTP request handling
 func (h *Server) Start() error {
-	h.metrics.response = make(map[string]elkstreams.MetricCounter)
-	h.metrics.requestTime = make(map[string]elkstreams.MetricHistogram)
-	for _, n := range []string{"total", "200", "400", "401", "403", "405", "500"} {
-		h.metrics.response[n] = h.MetricStorage.RegisterCounter("http.response." + n)
-		h.metrics.requestTime[n] = h.MetricStorage.RegisterHistogram("http.request_time." + n)
+	h.registerResponseMetrics()
+	h.metrics.queueLength = h.MetricStorage.RegisterGauge("http.async_queue.length")
+	h.metrics.asyncErrors = h.MetricStorage.RegisterCounter("http.async_queue.publish_errors")
+	h.metrics.bytesReceived = h.MetricStorage.RegisterCounter("http.bytes.received")
+	h.metrics.bytesDecompressed = h.MetricStorage.RegisterCounter("http.bytes.decompressed")
+	h.metrics.dropped = h.MetricStorage.RegisterCounter("http.events.dropped")
+	h.metrics.byIndex = helpers.NewLabeledCounters(h.MetricStorage, "http.index", h.Config.MetricsMaxLabels)
+	h.metrics.byProject = helpers.NewLabeledCounters(h.MetricStorage, "http.project", h.Config.MetricsMaxLabels)
+
+	if _, err := h.reloadKeyFiles(); err != nil {
+		return err
+	}
+	if err := h.ReloadProcessors(); err != nil {
+		return err
+	}
+	if err := CheckIndexRouting(h.Config.IndexRouting); err != nil {
+		return err
+	}
+	if h.Config.AsyncQueueSize < 1 {
+		return fmt.Errorf("async_queue_size must be positive, got %d", h.Config.AsyncQueueSize)
+	}
+	h.tomb.Go(h.watchKeyFiles)
+
+	h.queue = make(chan []*elkstreams.LogMessage, h.Config.AsyncQueueSize)
+	workers := h.Config.AsyncWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		h.tomb.Go(h.asyncWorker)
 	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", h.handleRequest)
 
@@ -50,10 +94,19 @@ func (h *Server) Start() error {
 	}
 	server.SetKeepAlivesEnabled(true)
 
+	if h.Config.TLS.Enabled {
+		if err := h.ReloadTLS(); err != nil {
+			return err
+		}
+	}
+
 	listener, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		return err
 	}
+	if h.Config.TLS.Enabled {
+		listener = tls.NewListener(listener, h.serverTLSConfig())
+	}
 
 	h.tomb.Go(func() error {
 		err := server.Serve(listener)
@@ -80,28 +133,131 @@ func (h *Server) Stop() error {
 }
 
 func (h *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if defaultIndex, defaultType, ok := h.readBulkPath(r.URL.Path); ok {
+		h.handleBulkRequest(w, r, defaultIndex, defaultType)
+		return
+	}
+
 	defer r.Body.Close()
 	start := time.Now()
 
-	statusCode, indexName, indexType, err := h.pipe(r)
+	statusCode, indexName, indexType, report, err := h.pipe(r)
 
-	t := float64(time.Since(start) / time.Millisecond)
-	h.metrics.response["total"].Add(1)
-	h.metrics.requestTime["total"].Observe(t)
+	t := h.observeResponse(statusCode, start)
 	if err != nil {
-		http.Error(w, err.Error(), statusCode)
 		h.Log.Warn("status", statusCode, "index", indexName, "type", indexType, "msg", "JSON processing pipeline failed", "error", err)
-		h.metrics.response[strconv.Itoa(statusCode)].Add(1)
-		h.metrics.requestTime[strconv.Itoa(statusCode)].Observe(t)
+		setRetryAfter(w, err)
+		if report != nil {
+			report.Error = err.Error()
+			h.writeJSON(w, statusCode, report)
+			return
+		}
+		http.Error(w, err.Error(), statusCode)
 		return
 	}
-	h.metrics.response["200"].Add(1)
-	h.metrics.requestTime["200"].Observe(t)
 	h.Log.Debug("status", statusCode, "index", indexName, "type", indexType, "duration", t)
+	if report != nil {
+		h.writeJSON(w, statusCode, report)
+		return
+	}
 	w.WriteHeader(statusCode)
 }
 
-func (h *Server) pipe(r *http.Request) (statusCode int, indexName, indexType string, err error) {
+func (h *Server) writeJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.Log.Warn("msg", "can't write response", "error", err)
+	}
+}
+
+// publishStatusCode returned 503 when broker is temporarily unavailable and 500 otherwise
+func publishStatusCode(err error) int {
+	if err == elkstreams.ErrNotConnected || err == elkstreams.ErrPublishTimeout {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// registerResponseMetrics registers response counters and request time histograms of each status code,
+// storages with labels get one counter and one histogram with code label without total ones
+func (h *Server) registerResponseMetrics() {
+	h.metrics.response = make(map[string]elkstreams.MetricCounter)
+	h.metrics.requestTime = make(map[string]elkstreams.MetricHistogram)
+	storage, labeled := h.MetricStorage.(elkstreams.LabeledMetricStorage)
+	for _, n := range []string{"total", "200", "202", "400", "401", "403", "405", "413", "415", "429", "500", "503"} {
+		if !labeled {
+			h.metrics.response[n] = h.MetricStorage.RegisterCounter("http.response." + n)
+			h.metrics.requestTime[n] = h.MetricStorage.RegisterHistogram("http.request_time." + n)
+			continue
+		}
+		responses, duration := "http.responses", "http.request_duration_milliseconds"
+		if n == "total" {
+			responses, duration = "", ""
+		}
+		h.metrics.response[n] = storage.RegisterLabeledCounter("http.response."+n, responses, "code", n)
+		h.metrics.requestTime[n] = storage.RegisterLabeledHistogram("http.request_time."+n, duration, "code", n)
+	}
+}
+
+// observeResponse updates response metrics and returned request duration in milliseconds
+func (h *Server) observeResponse(statusCode int, start time.Time) float64 {
+	t := float64(time.Since(start) / time.Millisecond)
+	h.metrics.response["total"].Add(1)
+	h.metrics.requestTime["total"].Observe(t)
+	h.metrics.response[strconv.Itoa(statusCode)].Add(1)
+	h.metrics.requestTime[strconv.Itoa(statusCode)].Observe(t)
+	return t
+}
+
+// observeIngest updates per-index and per-project counters of decoded messages, their bytes and rejected lines
+func (h *Server) observeIngest(key string, messages []*elkstreams.LogMessage, rejected map[string]int) {
+	type ingest struct {
+		messages, bytes, rejected int
+	}
+	var (
+		total   ingest
+		indices = make(map[string]*ingest)
+	)
+	index := func(name string) *ingest {
+		prefix := helpers.IndexPrefix(name)
+		if _, ok := indices[prefix]; !ok {
+			indices[prefix] = &ingest{}
+		}
+		return indices[prefix]
+	}
+	for _, message := range messages {
+		i := index(message.IndexName)
+		i.messages++
+		i.bytes += len(message.Body)
+		total.messages++
+		total.bytes += len(message.Body)
+	}
+	for name, count := range rejected {
+		index(name).rejected += count
+		total.rejected += count
+	}
+
+	for prefix, i := range indices {
+		h.addIngest(h.metrics.byIndex, prefix, i.messages, i.bytes, i.rejected)
+	}
+	apiKey, _ := h.apiKey(key)
+	h.addIngest(h.metrics.byProject, apiKey.OwnerName(key), total.messages, total.bytes, total.rejected)
+}
+
+func (h *Server) addIngest(counters *helpers.LabeledCounters, label string, messages, bytes, rejected int) {
+	if messages > 0 {
+		counters.Add(label, "messages", float64(messages))
+		counters.Add(label, "bytes", float64(bytes))
+	}
+	if rejected > 0 {
+		counters.Add(label, "rejected_lines", float64(rejected))
+	}
+}
+
+// pipe processes request, the report is returned when client asked for it with report=lines or strict=true query parameters
+func (h *Server) pipe(r *http.Request) (statusCode int, indexName, indexType string, report *ingestReport, err error) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
 		statusCode = http.StatusMethodNotAllowed
 		err = fmt.Errorf("only POST method supported")
@@ -113,18 +269,85 @@ func (h *Server) pipe(r *http.Request) (statusCode int, indexName, indexType str
 		return
 	}
 
-	if statusCode, err = h.authorize(r.Header.Get("Authorization"), indexName); err != nil {
+	var key string
+	if key, statusCode, err = h.authenticateRequest(r); err != nil {
+		return
+	}
+	// routed indices are checked when their date suffixes are known from events
+	routed := h.indexSuffix(indexName) != ""
+	if !routed {
+		if statusCode, err = h.checkIndex(key, indexName); err != nil {
+			return
+		}
+	}
+	if statusCode, err = h.checkType(key, indexType); err != nil {
+		return
+	}
+	if statusCode, err = h.limitRequest(key); err != nil {
 		return
 	}
 
+	var body *requestBody
+	if body, statusCode, err = h.openBody(r, h.maxBodySize(key)); err != nil {
+		return
+	}
+	defer h.closeBody(body)
+
+	query := r.URL.Query()
+	strict := helpers.ToBool(query.Get("strict"))
 	var decodedMessages []*elkstreams.LogMessage
-	if decodedMessages, err = h.decodeMessages(indexName, indexType, r.Body); err != nil {
+	decodedMessages, report, err = h.decodeMessagesWithReport(indexName, indexType, body, strict)
+	if report != nil {
+		h.observeIngest(key, decodedMessages, map[string]int{indexName: report.Rejected})
+	}
+	if query.Get("report") != "lines" && !strict {
+		report = nil
+	}
+	if err != nil {
 		statusCode = http.StatusBadRequest
+		if err == errBodyTooLarge {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		return
+	}
+	if routed {
+		indices := make(map[string]struct{})
+		for _, message := range decodedMessages {
+			indices[message.IndexName] = struct{}{}
+		}
+		if statusCode, err = h.checkIndices(key, indices); err != nil {
+			return
+		}
+	}
+	if decodedMessages, err = h.process(h.newProcessContext(r, key, start), decodedMessages); err != nil {
+		statusCode = http.StatusInternalServerError
+		return
+	}
+	if statusCode, err = h.limitEvents(key, decodedMessages); err != nil {
+		return
+	}
+	async := h.isAsyncPath(r.URL.Path)
+	if len(decodedMessages) == 0 {
+		// async clients always get the same status of accepted request
+		statusCode = http.StatusOK
+		if async {
+			statusCode = http.StatusAccepted
+		}
+		return
+	}
+
+	if async {
+		if err = h.enqueue(decodedMessages); err != nil {
+			statusCode = http.StatusServiceUnavailable
+			return
+		}
+		h.metrics.queueLength.Set(float64(len(h.queue)))
+		statusCode = http.StatusAccepted
 		return
 	}
 
 	if err = h.Publisher.Publish(decodedMessages); err != nil {
-		statusCode = http.StatusInternalServerError
+		statusCode = publishStatusCode(err)
 		return
 	}
 
@@ -1,21 +1,42 @@
 package http
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
 
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/helpers"
 	"github.com/AlexAkulov/candy-elk/logger"
 )
 
 func TestHTTP(t *testing.T) {
-	apiKeys := make(map[string][]string)
-	apiKeys["test-apikey"] = []string{"index1-????.??.??", "index2-*"}
+	apiKeys := make(map[string]APIKey)
+	apiKeys["test-apikey"] = APIKey{Indices: []string{"index1-????.??.??", "index2-*"}, Enabled: true}
 	h := Server{
 		Config: Config{
 			APIKeys: apiKeys,
@@ -51,35 +72,469 @@ func TestHTTP(t *testing.T) {
 		So(indexName, ShouldEqual, "index")
 		So(typeName, ShouldEqual, DefaultType)
 	})
+	Convey("Async path should be detected", t, func() {
+		So(h.isAsyncPath("/async-logs/index/type"), ShouldBeTrue)
+		So(h.isAsyncPath("//async-logs//index"), ShouldBeTrue)
+		So(h.isAsyncPath("/logs/index/type"), ShouldBeFalse)
+	})
+	Convey("Async queue should reject bulk when it is full", t, func() {
+		s := Server{queue: make(chan []*elkstreams.LogMessage, 1)}
+		bulk := []*elkstreams.LogMessage{&elkstreams.LogMessage{IndexName: "index", IndexType: "type"}}
+		So(s.enqueue(bulk), ShouldBeNil)
+		So(s.enqueue(bulk), ShouldEqual, errQueueFull)
+		So(<-s.queue, ShouldResemble, bulk)
+	})
+	Convey("Async queue should reject bulk when server is shutting down", t, func() {
+		s := Server{queue: make(chan []*elkstreams.LogMessage, 1)}
+		s.closeQueue()
+		So(s.enqueue([]*elkstreams.LogMessage{{IndexName: "index"}}), ShouldEqual, errQueueClosed)
+		So(s.queue, ShouldBeEmpty)
+	})
+	Convey("Server should not be started without async queue", t, func() {
+		s := Server{Log: logger.NewNopLogger(), MetricStorage: &counterStorage{counters: map[string]*counter{}}}
+		err := s.Start()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "async_queue_size")
+	})
+	Convey("Compressed body should be decoded", t, func() {
+		content := "{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message\":\"content\"}\n"
+		compress := func(encoding string) io.Reader {
+			var buf bytes.Buffer
+			var w io.WriteCloser
+			switch encoding {
+			case "gzip":
+				w = gzip.NewWriter(&buf)
+			case "deflate":
+				w = zlib.NewWriter(&buf)
+			case "raw-deflate":
+				w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+			case "zstd":
+				w, _ = zstd.NewWriter(&buf)
+			}
+			w.Write([]byte(content))
+			w.Close()
+			return &buf
+		}
+		for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "zstd"} {
+			r, _ := http.NewRequest(http.MethodPost, "/logs/index", compress(encoding))
+			r.Header.Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+			body, _, err := h.openBody(r, h.Config.MaxBodySize)
+			So(err, ShouldBeNil)
+			decoded, err := ioutil.ReadAll(body)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, content)
+			So(body.decompressed.n, ShouldEqual, len(content))
+		}
+		Convey("with unsupported encoding", func() {
+			r, _ := http.NewRequest(http.MethodPost, "/logs/index", strings.NewReader(content))
+			r.Header.Set("Content-Encoding", "br")
+			_, code, err := h.openBody(r, h.Config.MaxBodySize)
+			So(err, ShouldNotBeNil)
+			So(code, ShouldEqual, http.StatusUnsupportedMediaType)
+		})
+		Convey("with zstd window larger than limit", func() {
+			var buf bytes.Buffer
+			w, _ := zstd.NewWriter(&buf, zstd.WithWindowSize(2*zstdMaxWindowSize))
+			w.Write(bytes.Repeat([]byte(content), 1000))
+			w.Close()
+			r, _ := http.NewRequest(http.MethodPost, "/logs/index", &buf)
+			r.Header.Set("Content-Encoding", "zstd")
+			body, _, err := h.openBody(r, h.Config.MaxBodySize)
+			So(err, ShouldBeNil)
+			_, err = ioutil.ReadAll(body)
+			So(err, ShouldEqual, zstd.ErrWindowSizeExceeded)
+		})
+		Convey("larger than max body size", func() {
+			s := Server{Config: Config{MaxBodySize: 10}}
+			r, _ := http.NewRequest(http.MethodPost, "/logs/index", compress("gzip"))
+			r.Header.Set("Content-Encoding", "gzip")
+			body, _, err := s.openBody(r, s.Config.MaxBodySize)
+			So(err, ShouldBeNil)
+			_, err = ioutil.ReadAll(body)
+			So(err, ShouldEqual, errBodyTooLarge)
+		})
+	})
+	Convey("Bulk API path should be read correct", t, func() {
+		indexName, typeName, ok := h.readBulkPath("/_bulk")
+		So(ok, ShouldBeTrue)
+		So(indexName, ShouldEqual, "")
+		So(typeName, ShouldEqual, "")
+		indexName, typeName, ok = h.readBulkPath("/Index/_bulk")
+		So(ok, ShouldBeTrue)
+		So(indexName, ShouldEqual, "index")
+		So(typeName, ShouldEqual, "")
+		indexName, typeName, ok = h.readBulkPath("//index//type/_bulk/")
+		So(ok, ShouldBeTrue)
+		So(indexName, ShouldEqual, "index")
+		So(typeName, ShouldEqual, "type")
+		_, _, ok = h.readBulkPath("/logs/index/type")
+		So(ok, ShouldBeFalse)
+	})
 
 	Convey("Authorization header is empty then should return 401 error", t, func() {
-		code, err := h.authorize("", "")
+		code, err := pipeRequest(&h, logRequest("/logs/index2-abc", ""))
 		So(err, ShouldNotBeNil)
 		So(code, ShouldEqual, http.StatusUnauthorized)
 	})
 	Convey("Authorization header is valid then should not return error", t, func() {
-		_, err := h.authorize("ELK test-apikey", "index1-yyyy.mm.dd")
+		code, err := pipeRequest(&h, logRequest("/logs/index1-yyyy.mm.dd", "ELK test-apikey"))
 		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusOK)
 	})
 	Convey("Authorization header is valid should not then return error", t, func() {
-		_, err := h.authorize("ELK test-apikey", "index2-abc")
+		code, err := pipeRequest(&h, logRequest("/logs/index2-abc", "ELK test-apikey"))
 		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusOK)
 	})
 	Convey("Authorization exists, but header format is bad then should return 401", t, func() {
-		code, err := h.authorize("test-apikey", "index2-abc")
+		code, err := pipeRequest(&h, logRequest("/logs/index2-abc", "test-apikey"))
 		So(err, ShouldNotBeNil)
 		So(code, ShouldEqual, http.StatusUnauthorized)
 	})
 	Convey("Authorization key is not exists then should return 401", t, func() {
-		code, err := h.authorize("ELK bad-apikey", "index2-abc")
+		code, err := pipeRequest(&h, logRequest("/logs/index2-abc", "ELK bad-apikey"))
 		So(err, ShouldNotBeNil)
 		So(code, ShouldEqual, http.StatusUnauthorized)
 	})
 	Convey("Authorization key exists, but index has not then should return 403 error", t, func() {
-		code, err := h.authorize("ELK test-apikey", "index3")
+		code, err := pipeRequest(&h, logRequest("/logs/index3", "ELK test-apikey"))
 		So(err, ShouldNotBeNil)
 		So(code, ShouldEqual, http.StatusForbidden)
 	})
+	Convey("Authorization with settings of apikey", t, func() {
+		keys := Server{
+			Config: Config{
+				APIKeys: map[string]APIKey{
+					"ops-disabled": {Owner: "ops", Indices: []string{"*"}},
+					"ops-expired":  {Owner: "ops", Indices: []string{"*"}, Enabled: true, Expires: time.Now().Add(-time.Hour)},
+					"ops-typed":    {Owner: "ops", Indices: []string{"*"}, Enabled: true, Types: []string{"Log*"}, MaxBodySize: 10},
+				},
+				MaxBodySize: 100,
+			},
+		}
+		Convey("disabled key should return 401", func() {
+			code, err := pipeRequest(&keys, logRequest("/logs/index", "ELK ops-disabled"))
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(err.Error(), ShouldNotContainSubstring, "ops-disabled")
+		})
+		Convey("expired key should return 401", func() {
+			code, err := pipeRequest(&keys, logRequest("/logs/index", "ELK ops-expired"))
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(err.Error(), ShouldContainSubstring, "expired")
+		})
+		Convey("unknown key should not be echoed", func() {
+			_, err := pipeRequest(&keys, logRequest("/logs/index", "ELK secret-apikey"))
+			So(err.Error(), ShouldNotContainSubstring, "secret")
+		})
+		Convey("type should be checked", func() {
+			// allowed type passes to the body which is larger than limit of the key
+			code, _ := pipeRequest(&keys, logRequest("/logs/index/LogEvent", "ELK ops-typed"))
+			So(code, ShouldEqual, http.StatusRequestEntityTooLarge)
+			code, err := pipeRequest(&keys, logRequest("/logs/index/Metric", "ELK ops-typed"))
+			So(code, ShouldEqual, http.StatusForbidden)
+			So(err.Error(), ShouldContainSubstring, "'ops'")
+		})
+		Convey("max body size of key should override server limit", func() {
+			So(keys.maxBodySize("ops-typed"), ShouldEqual, 10)
+			So(keys.maxBodySize("ops-expired"), ShouldEqual, 100)
+		})
+	})
+	Convey("Authorization of routed indices", t, func() {
+		routed := Server{
+			Config: Config{
+				APIKeys: map[string]APIKey{
+					"test-apikey":  apiKeys["test-apikey"],
+					"other-apikey": {Indices: []string{"index2-*"}, Enabled: true},
+				},
+				IndexRouting: []IndexRoutingConfig{{Indices: []string{"index1"}, Suffix: SuffixDaily}},
+			},
+		}
+		Convey("should check index with date suffix of events", func() {
+			code, err := pipeRequest(&routed, logRequest("/logs/index1", "ELK test-apikey"))
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(routed.Publisher.(*publisherStub).messages[0].IndexName, ShouldEqual, "index1-2017.06.28")
+		})
+		Convey("should return 403 when routed index is not allowed", func() {
+			code, err := pipeRequest(&routed, logRequest("/logs/index1", "ELK other-apikey"))
+			So(code, ShouldEqual, http.StatusForbidden)
+			So(err.Error(), ShouldContainSubstring, "index1-2017.06.28")
+		})
+	})
+	Convey("Hashed API keys", t, func() {
+		sha256Hash, err := HashAPIKey("devops-secret")
+		So(err, ShouldBeNil)
+		bcryptHash, err := bcrypt.GenerateFromPassword([]byte("ops-secret"), bcrypt.MinCost)
+		So(err, ShouldBeNil)
+		keys := Server{
+			Config: Config{
+				APIKeys: map[string]APIKey{
+					"devops": {Hash: sha256Hash, Indices: []string{"*"}, Enabled: true},
+					"ops":    {Hash: string(bcryptHash), Indices: []string{"*"}, Enabled: true},
+				},
+			},
+		}
+		Convey("should be verified by salted SHA-256", func() {
+			key, _, err := keys.authenticate("ELK devops-secret")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "devops")
+		})
+		Convey("should be verified by bcrypt", func() {
+			key, _, err := keys.authenticate("ELK ops-secret")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "ops")
+			key, _, err = keys.authenticate("ELK ops-secret")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "ops")
+		})
+		Convey("failed bcrypt secret should be rejected without checking until ttl", func() {
+			_, code, err := keys.authenticate("ELK ops-wrong")
+			So(err, ShouldNotBeNil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(keys.keys.failed, ShouldHaveLength, 1)
+			_, _, err = keys.authenticate("ELK ops-wrong")
+			So(err, ShouldNotBeNil)
+			So(keys.keys.failed, ShouldHaveLength, 1)
+		})
+		Convey("bcrypt key should not be checked for secret without its name", func() {
+			_, _, err := keys.authenticate("ELK unknown-secret")
+			So(err, ShouldNotBeNil)
+			So(keys.keys.failed, ShouldBeEmpty)
+		})
+		Convey("name of hashed key should not be accepted as a key", func() {
+			_, code, err := keys.authenticate("ELK devops")
+			So(err, ShouldNotBeNil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("bad hash should not be read from YAML", func() {
+			var config Config
+			err := yaml.Unmarshal([]byte("api_keys:\n  devops:\n    hash: md5:abc\n"), &config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("API keys file", t, func() {
+		dir, err := ioutil.TempDir("", "apikeys")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, "devops.yml"), []byte("devops-apikey: [\"index1-*\"]\n"), 0600), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "ops.json"), []byte(`{"ops-apikey": {"indices": ["index2-*"]}}`), 0600), ShouldBeNil)
+		keys := Server{Config: Config{APIKeysFile: dir}}
+		reloaded, err := keys.reloadKeyFiles()
+		So(err, ShouldBeNil)
+		So(reloaded, ShouldBeTrue)
+		Convey("keys from all files of directory should be loaded", func() {
+			_, err := pipeRequest(&keys, logRequest("/logs/index1-abc", "ELK devops-apikey"))
+			So(err, ShouldBeNil)
+			_, err = pipeRequest(&keys, logRequest("/logs/index2-abc", "ELK ops-apikey"))
+			So(err, ShouldBeNil)
+		})
+		Convey("unchanged files should not be reloaded", func() {
+			reloaded, err := keys.reloadKeyFiles()
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldBeFalse)
+		})
+		Convey("changed files should be reloaded", func() {
+			So(os.Remove(filepath.Join(dir, "ops.json")), ShouldBeNil)
+			reloaded, err := keys.reloadKeyFiles()
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldBeTrue)
+			_, code, _ := keys.authenticate("ELK ops-apikey")
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("bad file should not replace loaded keys", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "bad.yml"), []byte("bad: {"), 0600), ShouldBeNil)
+			_, err := keys.reloadKeyFiles()
+			So(err, ShouldNotBeNil)
+			_, _, err = keys.authenticate("ELK devops-apikey")
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("TLS", t, func() {
+		dir, err := ioutil.TempDir("", "tls")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		So(writeCertificate(certFile, keyFile, "elkgate-1"), ShouldBeNil)
+		server := Server{
+			Config: Config{
+				TLS: TLSConfig{
+					Enabled:     true,
+					CertFile:    certFile,
+					KeyFile:     keyFile,
+					ClientCerts: map[string]APIKey{"shipper.example.com": {Indices: []string{"index1-*"}, Enabled: true}},
+				},
+			},
+		}
+		So(server.ReloadTLS(), ShouldBeNil)
+		Convey("certificate should be reloaded for new connections", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			listener = tls.NewListener(listener, server.serverTLSConfig())
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.(*tls.Conn).Handshake()
+					conn.Close()
+				}
+			}()
+			peerCN := func() string {
+				conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+				if err != nil {
+					return err.Error()
+				}
+				defer conn.Close()
+				return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			So(peerCN(), ShouldEqual, "elkgate-1")
+			So(writeCertificate(certFile, keyFile, "elkgate-2"), ShouldBeNil)
+			So(server.ReloadTLS(), ShouldBeNil)
+			So(peerCN(), ShouldEqual, "elkgate-2")
+		})
+		Convey("bad settings should not be loaded", func() {
+			server.Config.TLS.MinVersion = "2.0"
+			So(server.ReloadTLS(), ShouldNotBeNil)
+			server.Config.TLS.MinVersion = ""
+			server.Config.TLS.CipherSuites = []string{"TLS_BAD"}
+			So(server.ReloadTLS(), ShouldNotBeNil)
+		})
+		Convey("client should be authenticated by certificate SAN", func() {
+			shipper := func(location string) *http.Request {
+				r := logRequest(location, "")
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+					{Subject: pkix.Name{CommonName: "shipper"}, DNSNames: []string{"shipper.example.com"}},
+				}}}
+				return r
+			}
+			key, _, err := server.authenticateRequest(shipper("/logs/index1-abc"))
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, clientCertKeyPrefix+"shipper.example.com")
+			code, err := pipeRequest(&server, shipper("/logs/index1-abc"))
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, http.StatusOK)
+			code, err = pipeRequest(&server, shipper("/logs/index2-abc"))
+			So(code, ShouldEqual, http.StatusForbidden)
+			So(err.Error(), ShouldContainSubstring, "shipper.example.com")
+		})
+		Convey("client with unknown certificate should return 401", func() {
+			r, _ := http.NewRequest(http.MethodPost, "/logs/index1-abc", nil)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "other"}}}}}
+			_, code, err := server.authenticateRequest(r)
+			So(err, ShouldNotBeNil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+	Convey("Processors", t, func() {
+		debug, exists := "debug", true
+		processed := Server{
+			Config: Config{
+				APIKeys: apiKeys,
+				Processors: []ProcessorConfig{
+					{
+						Indices:            []string{"index1-*"},
+						Drop:               []DropCondition{{Field: "level", Equals: &debug}, {Field: "drop_me", Exists: &exists}},
+						RenameFields:       map[string]string{"msg": "message"},
+						RemoveFields:       []string{"password"},
+						AddFields:          map[string]string{"env": "prod"},
+						ReceivedAtField:    "@received_at",
+						ClientAddressField: "client_ip",
+						ProjectField:       "project",
+					},
+				},
+			},
+		}
+		processed.metrics.dropped = &counter{}
+		So(processed.ReloadProcessors(), ShouldBeNil)
+		r, _ := http.NewRequest(http.MethodPost, "/logs/index1-abc", nil)
+		r.RemoteAddr = "10.0.0.1:12345"
+		ctx := processed.newProcessContext(r, "test-apikey", time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+		messages := []*elkstreams.LogMessage{
+			{IndexName: "index1-abc", Body: []byte(`{"@timestamp":"2017","msg":"hello","password":"secret","count":1}`)},
+			{IndexName: "index1-abc", Body: []byte(`{"@timestamp":"2017","msg":"hello","level":"debug"}`)},
+			{IndexName: "index1-abc", Body: []byte(`{"@timestamp":"2017","level":"info","drop_me":1}`)},
+			{IndexName: "index2-abc", Body: []byte(`{"@timestamp":"2017","msg":"hello"}`)},
+		}
+		result, err := processed.process(ctx, messages)
+		So(err, ShouldBeNil)
+		So(len(result), ShouldEqual, 2)
+		So(string(result[0].Body), ShouldEqual, `{"@received_at":"2017-01-02T03:04:05Z","@timestamp":"2017","client_ip":"10.0.0.1","count":1,"env":"prod","message":"hello","project":"test"}`)
+		So(string(result[1].Body), ShouldEqual, `{"@timestamp":"2017","msg":"hello"}`)
+		So(processed.metrics.dropped.(*counter).v, ShouldEqual, 2)
+
+		Convey("fields should be renamed at once in stable order", func() {
+			list, err := compileProcessors([]ProcessorConfig{{
+				Indices:      []string{"*"},
+				RenameFields: map[string]string{"a": "b", "b": "c", "x": "c"},
+			}})
+			So(err, ShouldBeNil)
+			event := map[string]interface{}{"a": 1, "b": 2, "x": 3}
+			So(list[0].apply(event, ctx, ""), ShouldBeFalse)
+			So(event, ShouldResemble, map[string]interface{}{"b": 1, "c": 3})
+		})
+		Convey("dropped events should be reported as noop in bulk response", func() {
+			response := &bulkResponse{Items: []map[string]*bulkResponseItem{
+				{"index": {Status: http.StatusCreated, Result: "created"}},
+				{"index": {Status: http.StatusBadRequest, Error: &bulkResponseError{Type: "parse_exception"}}},
+				{"index": {Status: http.StatusCreated, Result: "created"}},
+			}}
+			decoded := []*elkstreams.LogMessage{{IndexName: "a"}, {IndexName: "b"}}
+			markDropped(response, decoded, decoded[:1])
+			So(response.Items[0]["index"].Result, ShouldEqual, "created")
+			So(response.Items[1]["index"].Status, ShouldEqual, http.StatusBadRequest)
+			So(response.Items[2]["index"].Result, ShouldEqual, "noop")
+			So(response.Items[2]["index"].Status, ShouldEqual, http.StatusOK)
+		})
+		Convey("request with only dropped events should be accepted on async path", func() {
+			storage := &counterStorage{counters: map[string]*counter{}}
+			processed.metrics.bytesReceived, processed.metrics.bytesDecompressed = &counter{}, &counter{}
+			processed.metrics.byIndex = helpers.NewLabeledCounters(storage, "http.index", 0)
+			processed.metrics.byProject = helpers.NewLabeledCounters(storage, "http.project", 0)
+			for path, expected := range map[string]int{
+				"/async-logs/index1-2017.01.02": http.StatusAccepted,
+				"/logs/index1-2017.01.02":       http.StatusOK,
+			} {
+				r, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(`{"@timestamp":"2017-01-02T03:04:05Z","level":"debug"}`))
+				r.Header.Set("Authorization", "ELK test-apikey")
+				statusCode, _, _, _, err := processed.pipe(r)
+				So(err, ShouldBeNil)
+				So(statusCode, ShouldEqual, expected)
+			}
+		})
+		Convey("bad processors should not be loaded", func() {
+			processed.Config.Processors = []ProcessorConfig{{Indices: []string{"*"}, Drop: []DropCondition{{Field: "a", Regex: "("}}}}
+			So(processed.ReloadProcessors(), ShouldNotBeNil)
+		})
+	})
+	Convey("API keys should be read from YAML", t, func() {
+		var config Config
+		err := yaml.Unmarshal([]byte(`
+api_keys:
+  old-apikey: ["index1-*", "index2-*"]
+  new-apikey:
+    owner: devops
+    indices: ["index3-*"]
+    types: ["LogEvent"]
+    expires: 2030-01-02
+    max_body_size: 1024
+  off-apikey:
+    indices: ["*"]
+    enabled: false
+`), &config)
+		So(err, ShouldBeNil)
+		So(config.APIKeys["old-apikey"], ShouldResemble, APIKey{Indices: []string{"index1-*", "index2-*"}, Enabled: true})
+		So(config.APIKeys["new-apikey"], ShouldResemble, APIKey{
+			Owner:       "devops",
+			Indices:     []string{"index3-*"},
+			Types:       []string{"LogEvent"},
+			Expires:     time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC),
+			Enabled:     true,
+			MaxBodySize: 1024,
+		})
+		So(config.APIKeys["off-apikey"].Enabled, ShouldBeFalse)
+	})
 	Convey("Decode one line body", t, func() {
 		indexName := "index"
 		indexType := "type"
@@ -122,6 +577,91 @@ func TestHTTP(t *testing.T) {
 		_, err := h.decodeMessages("index", "type", body)
 		So(err, ShouldNotBeNil)
 	})
+	Convey("Timestamp", t, func() {
+		Convey("in RFC3339 UTC should not be changed", func() {
+			message := []byte(`{"@timestamp":"2017-06-28T01:00:00.000Z","b":1,"a":2}`)
+			result, _, err := h.checkMessage(message)
+			So(err, ShouldBeNil)
+			So(string(result), ShouldEqual, string(message))
+		})
+		Convey("in other formats should be normalized to RFC3339 UTC", func() {
+			for value, expected := range map[string]string{
+				`"2017-06-28T03:00:00.5+02:00"`: "2017-06-28T01:00:00.5Z",
+				`"2017-06-28 01:00:00"`:         "2017-06-28T01:00:00Z",
+				`"2017-06-28T01:00:00"`:         "2017-06-28T01:00:00Z",
+				`1498611600`:                    "2017-06-28T01:00:00Z",
+				`1498611600123`:                 "2017-06-28T01:00:00.123Z",
+				`"1498611600"`:                  "2017-06-28T01:00:00Z",
+				`1498611600.25`:                 "2017-06-28T01:00:00.25Z",
+			} {
+				result, _, err := h.checkMessage([]byte(`{"message":"text","@timestamp":` + value + `}`))
+				So(err, ShouldBeNil)
+				So(string(result), ShouldEqual, `{"message":"text","@timestamp":"`+expected+`"}`)
+			}
+		})
+		Convey("should be normalized without changes of other fields", func() {
+			message := `{ "z": 12345678901234567890, "@timestamp" : 1498611600 , "a": {"@timestamp": 1, "b": 1.50} }`
+			result, _, err := h.checkMessage([]byte(message))
+			So(err, ShouldBeNil)
+			So(string(result), ShouldEqual, `{ "z": 12345678901234567890, "@timestamp" : "2017-06-28T01:00:00Z" , "a": {"@timestamp": 1, "b": 1.50} }`)
+			result, _, err = h.checkMessage([]byte(`{"@timestamp":1,"@timestamp":1498611600}`))
+			So(err, ShouldBeNil)
+			So(string(result), ShouldEqual, `{"@timestamp":1,"@timestamp":"2017-06-28T01:00:00Z"}`)
+		})
+		Convey("in unknown format should be rejected", func() {
+			_, _, err := h.checkMessage([]byte(`{"@timestamp":"yesterday"}`))
+			So(err.Error(), ShouldEqual, "@timestamp has unknown format")
+			_, _, err = h.checkMessage([]byte(`{"@timestamp":true}`))
+			So(err.Error(), ShouldEqual, "@timestamp must be a string or a number")
+		})
+		Convey("out of allowed range should be rejected", func() {
+			limited := Server{Config: Config{TimestampMaxFuture: 60, TimestampMaxPast: 3600}}
+			now := time.Now().UTC()
+			_, _, err := limited.checkMessage([]byte(`{"@timestamp":"` + now.Add(time.Hour).Format(time.RFC3339) + `"}`))
+			So(err.Error(), ShouldEqual, "@timestamp is too far in the future")
+			_, _, err = limited.checkMessage([]byte(`{"@timestamp":"` + now.Add(-2*time.Hour).Format(time.RFC3339) + `"}`))
+			So(err.Error(), ShouldEqual, "@timestamp is too far in the past")
+			_, _, err = limited.checkMessage([]byte(`{"@timestamp":"` + now.Format(time.RFC3339) + `"}`))
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("Index routing", t, func() {
+		routed := Server{
+			Config: Config{
+				APIKeys: apiKeys,
+				IndexRouting: []IndexRoutingConfig{
+					{Indices: []string{"index1"}, Suffix: SuffixDaily},
+					{Indices: []string{"index2-w"}, Suffix: SuffixWeekly},
+					{Indices: []string{"index3-m"}, Suffix: SuffixMonthly},
+				},
+			},
+			Log: logger.NewNopLogger(),
+		}
+		timestamp := time.Date(2017, 1, 1, 23, 0, 0, 0, time.FixedZone("", -3600))
+		So(routed.routeIndex("index1", timestamp), ShouldEqual, "index1-2017.01.02")
+		So(routed.routeIndex("index2-w", timestamp), ShouldEqual, "index2-w-2017.w01")
+		So(routed.routeIndex("index3-m", timestamp), ShouldEqual, "index3-m-2017.01")
+		So(routed.routeIndex("index3", timestamp), ShouldEqual, "index3")
+		So(CheckIndexRouting([]IndexRoutingConfig{{Indices: []string{"*"}, Suffix: "hourly"}}), ShouldNotBeNil)
+
+		Convey("should split one request into several indices", func() {
+			body := `{"@timestamp":"2017-06-28T01:00:00Z"}` + "\n" + `{"@timestamp":"2017-06-29T01:00:00Z"}` + "\n"
+			messages, err := routed.decodeMessages("index1", "type", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(messages[0].IndexName, ShouldEqual, "index1-2017.06.28")
+			So(messages[1].IndexName, ShouldEqual, "index1-2017.06.29")
+		})
+		Convey("should route sources of bulk request", func() {
+			body := `{"index":{"_index":"index1"}}` + "\n" + `{"@timestamp":"2017-06-28T01:00:00Z"}` + "\n" +
+				`{"index":{"_index":"index3-m"}}` + "\n" + `{"@timestamp":"2017-06-28T01:00:00Z"}` + "\n"
+			messages, res, err := routed.decodeBulk("test-apikey", "", "", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(len(messages), ShouldEqual, 1)
+			So(messages[0].IndexName, ShouldEqual, "index1-2017.06.28")
+			So(res.Items[0]["index"].Index, ShouldEqual, "index1-2017.06.28")
+			So(res.Items[1]["index"].Status, ShouldEqual, http.StatusForbidden)
+		})
+	})
 	Convey("Decode bulk with bad line", t, func() {
 		body := "{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\":\"content1\"}\n" +
 			"bad line\n" +
@@ -130,6 +670,29 @@ func TestHTTP(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(len(m), ShouldEqual, 2)
 	})
+	Convey("Decode bulk with bad lines and report", t, func() {
+		body := "{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\":\"content1\"}\n" +
+			"bad line\n" +
+			"{\"message3\":\"content3\"}\n" +
+			"{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message4\":\"content4\"}\n"
+		Convey("in normal mode", func() {
+			m, report, err := h.decodeMessagesWithReport("index", "type", strings.NewReader(body), false)
+			So(err, ShouldBeNil)
+			So(len(m), ShouldEqual, 2)
+			So(report.Accepted, ShouldEqual, 2)
+			So(report.Rejected, ShouldEqual, 2)
+			So(report.RejectedLines, ShouldResemble, []rejectedLine{
+				rejectedLine{Line: 2, Reason: "cannot unmarshal json"},
+				rejectedLine{Line: 3, Reason: "@timestamp field doesn't exist"},
+			})
+		})
+		Convey("in strict mode", func() {
+			m, report, err := h.decodeMessagesWithReport("index", "type", strings.NewReader(body), true)
+			So(err, ShouldNotBeNil)
+			So(m, ShouldBeNil)
+			So(report.Rejected, ShouldEqual, 2)
+		})
+	})
 	Convey("Decode bad bulk", t, func() {
 		body := "{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\"\"content1\"}\n" +
 			"bad line\n" +
@@ -211,4 +774,285 @@ func TestHTTP(t *testing.T) {
 		So(len(m), ShouldEqual, 3)
 		So(m, ShouldResemble, expectedMessage)
 	})
+	Convey("Decode Elasticsearch bulk request", t, func() {
+		Convey("with index and create actions", func() {
+			body := "{\"index\":{\"_index\":\"index2-abc\",\"_type\":\"type\"}}\n" +
+				"{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\":\"content1\"}\n" +
+				"{\"create\":{}}\n" +
+				"{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message2\":\"content2\"}\n"
+			m, res, err := h.decodeBulk("test-apikey", "index2-def", "", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(res.Errors, ShouldBeFalse)
+			So(len(res.Items), ShouldEqual, 2)
+			So(m, ShouldResemble, []*elkstreams.LogMessage{
+				&elkstreams.LogMessage{
+					IndexName: "index2-abc",
+					IndexType: "type",
+					Body:      []byte("{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\":\"content1\"}"),
+				},
+				&elkstreams.LogMessage{
+					IndexName: "index2-def",
+					IndexType: DefaultType,
+					Body:      []byte("{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message2\":\"content2\"}"),
+				},
+			})
+		})
+		Convey("with forbidden index and bad source", func() {
+			body := "{\"index\":{\"_index\":\"index3\"}}\n" +
+				"{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message1\":\"content1\"}\n" +
+				"{\"index\":{\"_index\":\"index2-abc\"}}\n" +
+				"bad line\n" +
+				"{\"delete\":{\"_index\":\"index2-abc\"}}\n" +
+				"{\"index\":{\"_index\":\"index2-abc\"}}\n" +
+				"{\"@timestamp\":\"2017-06-28T01:00:00.000Z\",\"message3\":\"content3\"}\n"
+			m, res, err := h.decodeBulk("test-apikey", "", "", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(res.Errors, ShouldBeTrue)
+			So(len(res.Items), ShouldEqual, 4)
+			So(res.Items[0]["index"].Status, ShouldEqual, http.StatusForbidden)
+			So(res.Items[1]["index"].Status, ShouldEqual, http.StatusBadRequest)
+			So(res.Items[2]["delete"].Status, ShouldEqual, http.StatusBadRequest)
+			So(res.Items[3]["index"].Status, ShouldEqual, http.StatusCreated)
+			So(len(m), ShouldEqual, 1)
+		})
+		Convey("with malformed action line", func() {
+			_, _, err := h.decodeBulk("test-apikey", "", "", strings.NewReader("bad line\n"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("without source line", func() {
+			_, _, err := h.decodeBulk("test-apikey", "index2-abc", "", strings.NewReader("{\"index\":{}}\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Ingest metrics", t, func() {
+		storage := &counterStorage{counters: map[string]*counter{}}
+		h.metrics.byIndex = helpers.NewLabeledCounters(storage, "http.index", 2)
+		h.metrics.byProject = helpers.NewLabeledCounters(storage, "http.project", 2)
+		messages := []*elkstreams.LogMessage{
+			{IndexName: "index1-2017.01.01", Body: []byte("1234")},
+			{IndexName: "index1-2017.01.02", Body: []byte("12")},
+			{IndexName: "index2-abc", Body: []byte("1")},
+		}
+		h.observeIngest("test-apikey", messages, map[string]int{"index2-abc": 3})
+		Convey("should be labeled by index prefix and project", func() {
+			So(storage.value("http.index.index1.messages"), ShouldEqual, 2)
+			So(storage.value("http.index.index1.bytes"), ShouldEqual, 6)
+			So(storage.value("http.index.index2-abc.rejected_lines"), ShouldEqual, 3)
+			So(storage.value("http.project.test.messages"), ShouldEqual, 3)
+			So(storage.value("http.project.test.bytes"), ShouldEqual, 7)
+			So(storage.value("http.project.test.rejected_lines"), ShouldEqual, 3)
+		})
+		Convey("should be capped", func() {
+			h.observeIngest("test-apikey", []*elkstreams.LogMessage{{IndexName: "index3", Body: []byte("1")}}, nil)
+			So(storage.value("http.index."+helpers.OverflowLabel+".messages"), ShouldEqual, 1)
+		})
+		Convey("should be labeled by prefix of weekly index", func() {
+			h.observeIngest("test-apikey", []*elkstreams.LogMessage{
+				{IndexName: "index1-2017.w05", Body: []byte("1")},
+				{IndexName: "index1_2017w06", Body: []byte("1")},
+			}, nil)
+			So(storage.value("http.index.index1.messages"), ShouldEqual, 4)
+			So(storage.value("http.index."+helpers.OverflowLabel+".messages"), ShouldEqual, 0)
+		})
+		Convey("should be one metric with label in storage with labels", func() {
+			labeled := &labeledStorage{counterStorage{counters: map[string]*counter{}}}
+			h.metrics.byIndex = helpers.NewLabeledCounters(labeled, "http.index", 2)
+			h.metrics.byProject = helpers.NewLabeledCounters(labeled, "http.project", 2)
+			h.observeIngest("test-apikey", messages, nil)
+			So(labeled.value(`http.index.messages{index="index1"}`), ShouldEqual, 2)
+			So(labeled.value(`http.index.messages{index="index2-abc"}`), ShouldEqual, 1)
+			So(labeled.value(`http.project.bytes{project="test"}`), ShouldEqual, 7)
+			So(labeled.value("http.index.index1.messages"), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Response metrics", t, func() {
+		Convey("should be labeled by status code in storage with labels", func() {
+			labeled := &labeledStorage{counterStorage{counters: map[string]*counter{}}}
+			s := Server{MetricStorage: labeled}
+			s.registerResponseMetrics()
+			s.observeResponse(http.StatusOK, time.Now())
+			So(labeled.value(`http.responses{code="200"}`), ShouldEqual, 1)
+			So(labeled.value(`http.request_duration_milliseconds{code="200"}`), ShouldEqual, 1)
+			So(labeled.value("http.response.200"), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Rate limits", t, func() {
+		limited := Server{
+			Config: Config{
+				RateLimits: map[string]RateLimit{
+					"test":              {RequestsPerSecond: 1, EventsPerSecond: 2, DailyEvents: 3},
+					DefaultRateLimitKey: {BytesPerSecond: 1},
+				},
+			},
+		}
+		messages := func(n int) []*elkstreams.LogMessage {
+			result := make([]*elkstreams.LogMessage, n)
+			for i := range result {
+				result[i] = &elkstreams.LogMessage{Body: []byte("{}")}
+			}
+			return result
+		}
+		Convey("requests over limit should be rejected with 429", func() {
+			code, err := limited.limitRequest("test-apikey")
+			So(err, ShouldBeNil)
+			code, err = limited.limitRequest("test-apikey")
+			So(code, ShouldEqual, http.StatusTooManyRequests)
+			So(err.(*rateLimitError).retryAfter, ShouldBeGreaterThan, 0)
+		})
+		Convey("events over limit should be rejected without taking tokens", func() {
+			_, err := limited.limitEvents("test-apikey", messages(2))
+			So(err, ShouldBeNil)
+			code, err := limited.limitEvents("test-apikey", messages(1))
+			So(code, ShouldEqual, http.StatusTooManyRequests)
+			limited.limits.limiters["test"].events.tokens = 2
+			_, err = limited.limitEvents("test-apikey", messages(1))
+			So(err, ShouldBeNil)
+		})
+		Convey("daily quota should be applied", func() {
+			_, err := limited.limitEvents("test-apikey", messages(2))
+			So(err, ShouldBeNil)
+			limited.limits.limiters["test"].events.tokens = 2
+			code, err := limited.limitEvents("test-apikey", messages(2))
+			So(code, ShouldEqual, http.StatusTooManyRequests)
+			So(err.Error(), ShouldContainSubstring, "daily quota")
+		})
+		Convey("default limits should be applied to other apikeys", func() {
+			_, err := limited.limitEvents("other-apikey", messages(1))
+			So(err, ShouldBeNil)
+			code, _ := limited.limitEvents("other-apikey", messages(1))
+			So(code, ShouldEqual, http.StatusTooManyRequests)
+		})
+		Convey("limits should be shared by apikeys of one owner", func() {
+			_, err := limited.limitRequest("test-apikey")
+			So(err, ShouldBeNil)
+			code, _ := limited.limitRequest("test-other-apikey")
+			So(code, ShouldEqual, http.StatusTooManyRequests)
+		})
+		Convey("limits should not be keyed by secret of plain apikey", func() {
+			limited.Config.RateLimits = map[string]RateLimit{"test-apikey": {RequestsPerSecond: 1}}
+			limited.limitRequest("test-apikey")
+			_, err := limited.limitRequest("test-apikey")
+			So(err, ShouldBeNil)
+		})
+		Convey("reloaded limits should be applied", func() {
+			limited.limitRequest("test-apikey")
+			limited.Config.RateLimits = map[string]RateLimit{"test": {RequestsPerSecond: 10}}
+			_, err := limited.limitRequest("test-apikey")
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+type counter struct {
+	v float64
+}
+
+func (c *counter) Add(delta float64) { c.v += delta }
+
+// Observe counts observations of counter used as histogram
+func (c *counter) Observe(float64) { c.v++ }
+
+type counterStorage struct {
+	counters map[string]*counter
+}
+
+func (s *counterStorage) RegisterCounter(name string) elkstreams.MetricCounter {
+	s.counters[name] = &counter{}
+	return s.counters[name]
+}
+
+func (s *counterStorage) RegisterHistogram(string) elkstreams.MetricHistogram { return nil }
+
+func (s *counterStorage) RegisterGauge(string) elkstreams.MetricGauge { return nil }
+
+func (s *counterStorage) value(name string) float64 {
+	if c, ok := s.counters[name]; ok {
+		return c.v
+	}
+	return 0
+}
+
+// labeledStorage is a counterStorage which registers labeled counters by name with label
+type labeledStorage struct {
+	counterStorage
+}
+
+func (s *labeledStorage) RegisterLabeledCounter(_, name, label, value string) elkstreams.MetricCounter {
+	return s.RegisterCounter(name + "{" + label + `="` + value + `"}`)
+}
+
+func (s *labeledStorage) RegisterLabeledHistogram(_, name, label, value string) elkstreams.MetricHistogram {
+	return s.RegisterCounter(name + "{" + label + `="` + value + `"}`).(*counter)
+}
+
+// publisherStub keeps published messages
+type publisherStub struct {
+	messages []*elkstreams.LogMessage
+}
+
+func (p *publisherStub) Start() error { return nil }
+
+func (p *publisherStub) Stop() error { return nil }
+
+func (p *publisherStub) Publish(messages []*elkstreams.LogMessage) error {
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+// logRequest returned POST request of one event to location with Authorization header if it is not empty
+func logRequest(location, header string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, location, strings.NewReader(`{"@timestamp":"2017-06-28T01:00:00.000Z","message":"content"}`))
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	return r
+}
+
+// pipeRequest passes request through pipe of server with logger, publisher stub and metrics which are not set yet
+func pipeRequest(s *Server, r *http.Request) (int, error) {
+	if s.Log == nil {
+		s.Log = logger.NewNopLogger()
+	}
+	if s.Publisher == nil {
+		s.Publisher = &publisherStub{}
+	}
+	if s.metrics.byIndex == nil {
+		storage := &counterStorage{counters: map[string]*counter{}}
+		s.metrics.bytesReceived, s.metrics.bytesDecompressed, s.metrics.dropped = &counter{}, &counter{}, &counter{}
+		s.metrics.byIndex = helpers.NewLabeledCounters(storage, "http.index", 0)
+		s.metrics.byProject = helpers.NewLabeledCounters(storage, "http.project", 0)
+	}
+	statusCode, _, _, _, err := s.pipe(r)
+	return statusCode, err
+}
+
+// writeCertificate writes self-signed certificate and its key to PEM files
+func writeCertificate(certFile, keyFile, commonName string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
 }
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const timestampField = "@timestamp"
+
+// timestampLayouts are accepted string formats of @timestamp, time without zone is UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds, it is 5138 year in seconds
+const epochMillisThreshold = 1e11
+
+// parseTimestamp parses @timestamp in RFC3339, RFC3339Nano, "2006-01-02 15:04:05" formats and epoch seconds or milliseconds,
+// it returned true if value is already RFC3339 time in UTC and doesn't need to be normalized
+func parseTimestamp(raw json.RawMessage) (time.Time, bool, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return time.Time{}, false, fmt.Errorf("@timestamp must be a string or a number")
+		}
+		t, err := parseEpoch(string(n))
+		return t, false, err
+	}
+
+	for i, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, i == 0 && strings.HasSuffix(s, "Z"), nil
+		}
+	}
+	if t, err := parseEpoch(s); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("@timestamp has unknown format")
+}
+
+// parseEpoch parses epoch seconds or milliseconds, fractional part is rounded to microseconds
+func parseEpoch(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n >= epochMillisThreshold || n <= -epochMillisThreshold {
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+		return time.Time{}, fmt.Errorf("@timestamp has unknown format")
+	}
+	if math.Abs(n) >= epochMillisThreshold {
+		n /= 1000
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*int64(time.Microsecond)), nil
+}
+
+// checkTimestamp checks that time is in allowed range relative to now
+func (h *Server) checkTimestamp(t time.Time, now time.Time) error {
+	if h.Config.TimestampMaxFuture > 0 && t.Sub(now) > time.Duration(h.Config.TimestampMaxFuture)*time.Second {
+		return fmt.Errorf("@timestamp is too far in the future")
+	}
+	if h.Config.TimestampMaxPast > 0 && now.Sub(t) > time.Duration(h.Config.TimestampMaxPast)*time.Second {
+		return fmt.Errorf("@timestamp is too far in the past")
+	}
+	return nil
+}
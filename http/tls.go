@@ -0,0 +1,166 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientCertKeyPrefix is a prefix of apikey names for clients authenticated by certificate
+const clientCertKeyPrefix = "cert:"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsState keeps current TLS settings and certificate, they are replaced on reload
+type tlsState struct {
+	mu          sync.RWMutex
+	config      *tls.Config
+	certificate *tls.Certificate
+}
+
+// loadTLSConfig builds tls.Config from settings, certificates are loaded from files
+func loadTLSConfig(c TLSConfig) (*tls.Config, *tls.Certificate, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, nil, fmt.Errorf("tls cert_file and key_file are required")
+	}
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't load tls certificate: %v", err)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown tls min_version '%s', expected 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(c.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown tls cipher suite '%s'", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't read tls client_ca_file: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in tls client_ca_file")
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, &certificate, nil
+}
+
+// ReloadTLS reloads certificate, client CA and TLS settings, new connections use them immediately
+func (h *Server) ReloadTLS() error {
+	if !h.Config.TLS.Enabled {
+		return nil
+	}
+	config, certificate, err := loadTLSConfig(h.Config.TLS)
+	if err != nil {
+		return err
+	}
+	h.tls.mu.Lock()
+	h.tls.config, h.tls.certificate = config, certificate
+	h.tls.mu.Unlock()
+	return nil
+}
+
+// serverTLSConfig returned config of listener which takes current settings for each connection
+func (h *Server) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			h.tls.mu.RLock()
+			defer h.tls.mu.RUnlock()
+			config := h.tls.config.Clone()
+			config.Certificates = []tls.Certificate{*h.tls.certificate}
+			return config, nil
+		},
+	}
+}
+
+// clientCertNames returned CN and SAN of verified client certificate
+func clientCertNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := []string{}
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// authenticateRequest returned name of apikey from Authorization header,
+// without the header client is authenticated by CN or SAN of its certificate
+func (h *Server) authenticateRequest(r *http.Request) (string, int, error) {
+	header := r.Header.Get("Authorization")
+	if header != "" || len(h.Config.TLS.ClientCerts) == 0 {
+		return h.authenticate(header)
+	}
+	names := clientCertNames(r)
+	if len(names) == 0 {
+		return h.authenticate(header)
+	}
+	for _, name := range names {
+		clientCert, ok := h.Config.TLS.ClientCerts[name]
+		if !ok {
+			continue
+		}
+		if !clientCert.Enabled {
+			return "", http.StatusUnauthorized, fmt.Errorf("client certificate '%s' is disabled", name)
+		}
+		if clientCert.Expired(time.Now()) {
+			return "", http.StatusUnauthorized, fmt.Errorf("client certificate '%s' expired at %s", name, clientCert.Expires.Format(time.RFC3339))
+		}
+		return clientCertKeyPrefix + name, 0, nil
+	}
+	return "", http.StatusUnauthorized, fmt.Errorf("client certificate '%s' is not allowed", names[0])
+}
+
+// clientCertKey returned settings of client certificate by apikey name
+func (h *Server) clientCertKey(name string) (APIKey, bool) {
+	if !strings.HasPrefix(name, clientCertKeyPrefix) {
+		return APIKey{}, false
+	}
+	certName := strings.TrimPrefix(name, clientCertKeyPrefix)
+	clientCert, ok := h.Config.TLS.ClientCerts[certName]
+	if ok && clientCert.Owner == "" {
+		clientCert.Owner = certName
+	}
+	return clientCert, ok
+}
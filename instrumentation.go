@@ -19,6 +19,14 @@ type MetricStorage interface {
 	RegisterGauge(string) MetricGauge
 }
 
+// LabeledMetricStorage is implemented by storages which support labels, metric is registered as
+// graphiteName in backends without labels and as name with label of given value in others like Prometheus,
+// metric with empty name is registered only in backends without labels
+type LabeledMetricStorage interface {
+	RegisterLabeledCounter(graphiteName, name, label, value string) MetricCounter
+	RegisterLabeledHistogram(graphiteName, name, label, value string) MetricHistogram
+}
+
 // MetricHistogram is a simple histogram
 type MetricHistogram interface {
 	Observe(float64)
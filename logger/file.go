@@ -0,0 +1,187 @@
+package logger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is a suffix of rotated log files
+const backupTimeFormat = "20060102T150405.000"
+
+// RotateConfig settings of self-rotation, zero max_size and max_age disable rotation
+// and zero max_backups keeps all rotated files
+type RotateConfig struct {
+	MaxSize    int64 `yaml:"max_size"`
+	MaxAge     int64 `yaml:"max_age"`
+	MaxBackups int   `yaml:"max_backups"`
+}
+
+// File is a log file which can be reopened after external rotation and rotates itself by size or age
+type File struct {
+	path   string
+	config RotateConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+// OpenFile opens log file for appending
+func OpenFile(path string, config RotateConfig) (*File, error) {
+	f := &File{path: path, config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write writes p to the file, the file is rotated before if it exceeded max_size or max_age,
+// os.ErrClosed is returned after Close until the file is reopened
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.needRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "can't rotate logfile %s: %s\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) needRotate(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+n > f.config.MaxSize {
+		return true
+	}
+	return f.config.MaxAge > 0 && time.Since(f.opened) >= time.Duration(f.config.MaxAge)*time.Second
+}
+
+// rotate renames current file with timestamp suffix, opens new one and removes old backups
+func (f *File) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeBackups()
+}
+
+// removeBackups removes the oldest rotated files over max_backups
+func (f *File) removeBackups() error {
+	if f.config.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.config.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups returned paths of files rotated by this code from the oldest to the newest,
+// other files with the same prefix are not matched
+func (f *File) backups() ([]string, error) {
+	dir, base := filepath.Split(f.path)
+	files, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(name, base+".")); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// Reopen closes and opens the file again, it is used after the file was moved by external logrotate
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.closed = false
+	return nil
+}
+
+// ReopenOrWarn reopens the file if it is opened and reports failure to stderr,
+// it is called on SIGUSR1 from main of each service
+func (f *File) ReopenOrWarn() {
+	if f == nil {
+		return
+	}
+	if err := f.Reopen(); err != nil {
+		fmt.Fprintf(os.Stderr, "can't reopen logfile %s: %s\n", f.path, err)
+	}
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
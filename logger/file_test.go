@@ -0,0 +1,125 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFile(t *testing.T) {
+	Convey("Log file", t, func() {
+		dir, err := ioutil.TempDir("", "elk-logger")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "elkgate.log")
+		names := func() []string {
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			var result []string
+			for _, file := range files {
+				result = append(result, file.Name())
+			}
+			sort.Strings(result)
+			return result
+		}
+		read := func(name string) string {
+			content, err := ioutil.ReadFile(filepath.Join(dir, name))
+			So(err, ShouldBeNil)
+			return string(content)
+		}
+
+		Convey("is rotated by size", func() {
+			f, err := OpenFile(path, RotateConfig{MaxSize: 10})
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			_, err = f.Write([]byte("first\n"))
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("second\n"))
+			So(err, ShouldBeNil)
+
+			files := names()
+			So(files, ShouldHaveLength, 2)
+			So(files[0], ShouldEqual, "elkgate.log")
+			So(read(files[0]), ShouldEqual, "second\n")
+			So(read(files[1]), ShouldEqual, "first\n")
+		})
+
+		Convey("is not rotated while it is empty", func() {
+			f, err := OpenFile(path, RotateConfig{MaxSize: 1})
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			_, err = f.Write([]byte("long line\n"))
+			So(err, ShouldBeNil)
+			So(names(), ShouldResemble, []string{"elkgate.log"})
+		})
+
+		Convey("is reopened after external rotation", func() {
+			f, err := OpenFile(path, RotateConfig{})
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			_, err = f.Write([]byte("first\n"))
+			So(err, ShouldBeNil)
+			So(os.Rename(path, path+".1"), ShouldBeNil)
+			f.ReopenOrWarn()
+			_, err = f.Write([]byte("second\n"))
+			So(err, ShouldBeNil)
+
+			So(read("elkgate.log"), ShouldEqual, "second\n")
+			So(read("elkgate.log.1"), ShouldEqual, "first\n")
+		})
+
+		Convey("is not written after close until reopened", func() {
+			f, err := OpenFile(path, RotateConfig{})
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			_, err = f.Write([]byte("lost\n"))
+			So(err, ShouldEqual, os.ErrClosed)
+			So(read("elkgate.log"), ShouldEqual, "")
+
+			So(f.Reopen(), ShouldBeNil)
+			defer f.Close()
+			_, err = f.Write([]byte("reopened\n"))
+			So(err, ShouldBeNil)
+			So(read("elkgate.log"), ShouldEqual, "reopened\n")
+		})
+
+		Convey("nil file is not reopened", func() {
+			var f *File
+			So(f.ReopenOrWarn, ShouldNotPanic)
+		})
+
+		Convey("removes only the oldest own backups", func() {
+			start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i := 0; i < 3; i++ {
+				backup := path + "." + start.Add(time.Duration(i)*time.Hour).Format(backupTimeFormat)
+				So(ioutil.WriteFile(backup, nil, 0644), ShouldBeNil)
+			}
+			for _, name := range []string{"elkgate.log.1", "elkgate.log.gz", "elkgate.log-old"} {
+				So(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644), ShouldBeNil)
+			}
+
+			f, err := OpenFile(path, RotateConfig{MaxBackups: 2})
+			So(err, ShouldBeNil)
+			defer f.Close()
+			So(f.removeBackups(), ShouldBeNil)
+
+			So(names(), ShouldResemble, []string{
+				"elkgate.log",
+				"elkgate.log-old",
+				"elkgate.log.1",
+				"elkgate.log.20180101T010000.000",
+				"elkgate.log.20180101T020000.000",
+				"elkgate.log.gz",
+			})
+		})
+	})
+}
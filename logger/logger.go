@@ -1,11 +1,17 @@
 package logger
 
 import (
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/go-kit/kit/log"
-	"fmt"
+)
+
+// Formats of log output
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
 )
 
 type Level int
@@ -22,16 +28,25 @@ type Logger struct {
 	Level  Level
 }
 
-func New(logLevel string, writer io.Writer) *Logger {
+// New creates logger which writes logfmt or JSON lines, empty format means logfmt
+func New(logLevel string, logFormat string, writer io.Writer) (*Logger, error) {
 	myTimestamp := log.Valuer(func() interface{} {
 		return time.Now().Format(time.RFC3339)
 	})
-	l := log.NewLogfmtLogger(log.NewSyncWriter(writer))
+	var l log.Logger
+	switch logFormat {
+	case "", FormatLogfmt:
+		l = log.NewLogfmtLogger(log.NewSyncWriter(writer))
+	case FormatJSON:
+		l = log.NewJSONLogger(log.NewSyncWriter(writer))
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', expected '%s' or '%s'", logFormat, FormatLogfmt, FormatJSON)
+	}
 	l = log.With(l, "ts", myTimestamp)
 	return &Logger{
 		logger: l,
 		Level:  parseLevel(logLevel),
-	}
+	}, nil
 }
 
 func (l *Logger) SetLevel(logLevel string) {
@@ -89,5 +104,5 @@ func (l *Logger) Error(keyvals ...interface{}) {
 }
 
 func (l *Logger) Printf(format string, v ...interface{}) {
-	l.Debug("msg", fmt.Sprintf(format, v))
+	l.Debug("msg", fmt.Sprintf(format, v...))
 }
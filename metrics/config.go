@@ -1,8 +1,17 @@
 package metrics
 
-// Config is settings for graphite
+// Config is settings for graphite and prometheus
 type Config struct {
-	Enabled                  bool   `yaml:"enabled"`
-	GraphiteConnectionString string `yaml:"graphite_connection_string"`
-	GraphitePrefix           string `yaml:"graphite_prefix"`
+	Enabled                  bool             `yaml:"enabled"`
+	GraphiteConnectionString string           `yaml:"graphite_connection_string"`
+	GraphitePrefix           string           `yaml:"graphite_prefix"`
+	Prometheus               PrometheusConfig `yaml:"prometheus"`
+}
+
+// PrometheusConfig is settings for prometheus /metrics endpoint
+type PrometheusConfig struct {
+	Enabled   bool      `yaml:"enabled"`
+	Listen    string    `yaml:"listen"`
+	Namespace string    `yaml:"namespace"`
+	Buckets   []float64 `yaml:"buckets"`
 }
@@ -1,7 +1,9 @@
 package metrics
 
 import (
+	"context"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/go-kit/kit/metrics/graphite"
@@ -9,11 +11,14 @@ import (
 	"github.com/AlexAkulov/candy-elk"
 )
 
-// MetricStorage is a Graphite implementation of elkstreams.MetricStorage interface
+// MetricStorage is a Graphite and Prometheus implementation of elkstreams.MetricStorage interface,
+// metrics are registered in both backends and each enabled backend reports them
 type MetricStorage struct {
-	Config   Config
-	Log      elkstreams.Logger
-	registry *graphite.Graphite
+	Config     Config
+	Log        elkstreams.Logger
+	registry   *graphite.Graphite
+	prometheus *prometheusRegistry
+	server     *http.Server
 }
 
 func (ms *MetricStorage) run() {
@@ -40,34 +45,145 @@ func (ms *MetricStorage) run() {
 
 }
 
-// Start initializes Graphite reporter
+// Start initializes Graphite reporter and Prometheus listener
 func (ms *MetricStorage) Start() error {
 	ms.registry = graphite.New(ms.Config.GraphitePrefix, nil)
 	if ms.Config.Enabled {
 		ms.Log.Debug("msg", "Graphite enabled")
 		ms.run()
+	} else {
+		ms.Log.Debug("msg", "Graphite disabled")
+	}
+
+	if !ms.Config.Prometheus.Enabled {
+		ms.Log.Debug("msg", "Prometheus disabled")
 		return nil
 	}
-	ms.Log.Debug("msg", "Graphite disabled")
+	ms.prometheus = newPrometheusRegistry(ms.Config.Prometheus.Namespace, ms.Config.Prometheus.Buckets)
+	listener, err := net.Listen("tcp", ms.Config.Prometheus.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ms.prometheus)
+	ms.server = &http.Server{Handler: mux}
+	go func() {
+		if err := ms.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			ms.Log.Error("msg", "prometheus listener failed", "err", err)
+		}
+	}()
+	ms.Log.Debug("msg", "Prometheus enabled", "listen", listener.Addr())
 	return nil
 }
 
-// Stop does nothing - there is no way to gracefully flush Graphite reporter
+// Stop closes Prometheus listener, there is no way to gracefully flush Graphite reporter
 func (ms *MetricStorage) Stop() error {
-	return nil
+	if ms.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return ms.server.Shutdown(ctx)
 }
 
 // RegisterHistogram creates a uniform-sampled histogram of integers
 func (ms *MetricStorage) RegisterHistogram(name string) elkstreams.MetricHistogram {
-	return ms.registry.NewHistogram(name, 50)
+	h := ms.registry.NewHistogram(name, 50)
+	if ms.prometheus == nil {
+		return h
+	}
+	p, err := ms.prometheus.histogram(name)
+	if err != nil {
+		ms.Log.Error("msg", "metric is not exported to prometheus", "err", err)
+		return h
+	}
+	return multiHistogram{h, p}
 }
 
 // RegisterCounter creates a counter
 func (ms *MetricStorage) RegisterCounter(name string) elkstreams.MetricCounter {
-	return ms.registry.NewCounter(name)
+	c := ms.registry.NewCounter(name)
+	if ms.prometheus == nil {
+		return c
+	}
+	p, err := ms.prometheus.counter(name)
+	if err != nil {
+		ms.Log.Error("msg", "metric is not exported to prometheus", "err", err)
+		return c
+	}
+	return multiCounter{c, p}
+}
+
+// RegisterLabeledCounter creates a counter named graphiteName in Graphite
+// and a counter of one family with label in Prometheus if name is not empty
+func (ms *MetricStorage) RegisterLabeledCounter(graphiteName, name, label, value string) elkstreams.MetricCounter {
+	c := ms.registry.NewCounter(graphiteName)
+	if ms.prometheus == nil || name == "" {
+		return c
+	}
+	p, err := ms.prometheus.labeledCounter(name, label, value)
+	if err != nil {
+		ms.Log.Error("msg", "metric is not exported to prometheus", "err", err)
+		return c
+	}
+	return multiCounter{c, p}
+}
+
+// RegisterLabeledHistogram creates a histogram named graphiteName in Graphite
+// and a histogram of one family with label in Prometheus if name is not empty
+func (ms *MetricStorage) RegisterLabeledHistogram(graphiteName, name, label, value string) elkstreams.MetricHistogram {
+	h := ms.registry.NewHistogram(graphiteName, 50)
+	if ms.prometheus == nil || name == "" {
+		return h
+	}
+	p, err := ms.prometheus.labeledHistogram(name, label, value)
+	if err != nil {
+		ms.Log.Error("msg", "metric is not exported to prometheus", "err", err)
+		return h
+	}
+	return multiHistogram{h, p}
 }
 
 // RegisterGauge creates a gauge
 func (ms *MetricStorage) RegisterGauge(name string) elkstreams.MetricGauge {
-	return ms.registry.NewGauge(name)
+	g := ms.registry.NewGauge(name)
+	if ms.prometheus == nil {
+		return g
+	}
+	p, err := ms.prometheus.gauge(name)
+	if err != nil {
+		ms.Log.Error("msg", "metric is not exported to prometheus", "err", err)
+		return g
+	}
+	return multiGauge{g, p}
+}
+
+type multiHistogram []elkstreams.MetricHistogram
+
+func (m multiHistogram) Observe(value float64) {
+	for _, h := range m {
+		h.Observe(value)
+	}
+}
+
+type multiCounter []elkstreams.MetricCounter
+
+func (m multiCounter) Add(delta float64) {
+	for _, c := range m {
+		c.Add(delta)
+	}
+}
+
+type multiGauge []elkstreams.MetricGauge
+
+func (m multiGauge) Add(delta float64) {
+	for _, g := range m {
+		g.Add(delta)
+	}
+}
+
+func (m multiGauge) Set(value float64) {
+	for _, g := range m {
+		g.Set(value)
+	}
 }
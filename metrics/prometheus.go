@@ -0,0 +1,380 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kinds of registered metrics, one name can't be used by metrics of different kinds
+const (
+	kindCounter          = "counter"
+	kindLabeledCounter   = "labeled counter"
+	kindGauge            = "gauge"
+	kindHistogram        = "histogram"
+	kindLabeledHistogram = "labeled histogram"
+)
+
+// DefaultBuckets are upper bounds of histogram buckets in milliseconds
+var DefaultBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// prometheusRegistry keeps metrics and writes them in prometheus text exposition format
+type prometheusRegistry struct {
+	namespace         string
+	buckets           []float64
+	mu                sync.Mutex
+	counters          map[string]*prometheusCounter
+	labeled           map[string]map[string]*prometheusCounter
+	gauges            map[string]*prometheusGauge
+	histograms        map[string]*prometheusHistogram
+	labeledHistograms map[string]map[string]*prometheusHistogram
+}
+
+func newPrometheusRegistry(namespace string, buckets []float64) *prometheusRegistry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	return &prometheusRegistry{
+		namespace:         namespace,
+		buckets:           b,
+		counters:          make(map[string]*prometheusCounter),
+		labeled:           make(map[string]map[string]*prometheusCounter),
+		gauges:            make(map[string]*prometheusGauge),
+		histograms:        make(map[string]*prometheusHistogram),
+		labeledHistograms: make(map[string]map[string]*prometheusHistogram),
+	}
+}
+
+// metricName converts graphite-like name to valid prometheus metric name
+func (r *prometheusRegistry) metricName(name string) string {
+	if r.namespace != "" {
+		name = r.namespace + "_" + name
+	}
+	result := []byte(name)
+	for i, c := range result {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || i > 0 && c >= '0' && c <= '9') {
+			result[i] = '_'
+		}
+	}
+	return string(result)
+}
+
+// counterName returned metric name of counter with _total suffix
+func (r *prometheusRegistry) counterName(name string) string {
+	name = r.metricName(name)
+	if !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
+// formatLabel returned label pair with escaped value in prometheus text format
+func formatLabel(label, value string) string {
+	return fmt.Sprintf("%s=\"%s\"", label, labelValueReplacer.Replace(value))
+}
+
+// usedBy returned kind of metric registered with name or empty string, it must be called under lock
+func (r *prometheusRegistry) usedBy(name string) string {
+	if _, ok := r.counters[name]; ok {
+		return kindCounter
+	}
+	if _, ok := r.labeled[name]; ok {
+		return kindLabeledCounter
+	}
+	if _, ok := r.gauges[name]; ok {
+		return kindGauge
+	}
+	if _, ok := r.histograms[name]; ok {
+		return kindHistogram
+	}
+	if _, ok := r.labeledHistograms[name]; ok {
+		return kindLabeledHistogram
+	}
+	return ""
+}
+
+// checkKind returned error if name is already used by metric of another kind, it must be called under lock
+func (r *prometheusRegistry) checkKind(name, kind string) error {
+	if used := r.usedBy(name); used != "" && used != kind {
+		return fmt.Errorf("metric %s can't be registered as %s, it is already registered as %s", name, kind, used)
+	}
+	return nil
+}
+
+func (r *prometheusRegistry) counter(name string) (*prometheusCounter, error) {
+	name = r.counterName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkKind(name, kindCounter); err != nil {
+		return nil, err
+	}
+	if c, ok := r.counters[name]; ok {
+		return c, nil
+	}
+	c := &prometheusCounter{}
+	r.counters[name] = c
+	return c, nil
+}
+
+// labeledCounter returned counter of family name with label, all label values are written as one metric
+func (r *prometheusRegistry) labeledCounter(name, label, value string) (*prometheusCounter, error) {
+	name = r.counterName(name)
+	labels := formatLabel(label, value)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkKind(name, kindLabeledCounter); err != nil {
+		return nil, err
+	}
+	family, ok := r.labeled[name]
+	if !ok {
+		family = make(map[string]*prometheusCounter)
+		r.labeled[name] = family
+	}
+	if c, ok := family[labels]; ok {
+		return c, nil
+	}
+	c := &prometheusCounter{}
+	family[labels] = c
+	return c, nil
+}
+
+func (r *prometheusRegistry) gauge(name string) (*prometheusGauge, error) {
+	name = r.metricName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkKind(name, kindGauge); err != nil {
+		return nil, err
+	}
+	if g, ok := r.gauges[name]; ok {
+		return g, nil
+	}
+	g := &prometheusGauge{}
+	r.gauges[name] = g
+	return g, nil
+}
+
+func (r *prometheusRegistry) histogram(name string) (*prometheusHistogram, error) {
+	name = r.metricName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkKind(name, kindHistogram); err != nil {
+		return nil, err
+	}
+	if h, ok := r.histograms[name]; ok {
+		return h, nil
+	}
+	h := r.newHistogram()
+	r.histograms[name] = h
+	return h, nil
+}
+
+// labeledHistogram returned histogram of family name with label, all label values are written as one metric
+func (r *prometheusRegistry) labeledHistogram(name, label, value string) (*prometheusHistogram, error) {
+	name = r.metricName(name)
+	labels := formatLabel(label, value)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkKind(name, kindLabeledHistogram); err != nil {
+		return nil, err
+	}
+	family, ok := r.labeledHistograms[name]
+	if !ok {
+		family = make(map[string]*prometheusHistogram)
+		r.labeledHistograms[name] = family
+	}
+	if h, ok := family[labels]; ok {
+		return h, nil
+	}
+	h := r.newHistogram()
+	family[labels] = h
+	return h, nil
+}
+
+func (r *prometheusRegistry) newHistogram() *prometheusHistogram {
+	return &prometheusHistogram{
+		buckets: r.buckets,
+		counts:  make([]uint64, len(r.buckets)),
+	}
+}
+
+// write writes all metrics sorted by name in prometheus text format
+func (r *prometheusRegistry) write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.counters)+len(r.labeled)+len(r.gauges)+len(r.histograms)+len(r.labeledHistograms))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.labeled {
+		names = append(names, name)
+	}
+	for name := range r.gauges {
+		names = append(names, name)
+	}
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	for name := range r.labeledHistograms {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.mu.Lock()
+		c, isCounter := r.counters[name]
+		family, isLabeled := r.labeled[name]
+		series := make(map[string]*prometheusCounter, len(family))
+		labels := make([]string, 0, len(family))
+		for l, c := range family {
+			series[l] = c
+			labels = append(labels, l)
+		}
+		g, isGauge := r.gauges[name]
+		h, isHistogram := r.histograms[name]
+		histograms, isLabeledHistogram := r.labeledHistograms[name]
+		histogramSeries := make(map[string]*prometheusHistogram, len(histograms))
+		for l, h := range histograms {
+			histogramSeries[l] = h
+			labels = append(labels, l)
+		}
+		r.mu.Unlock()
+		switch {
+		case isCounter:
+			fmt.Fprintf(bw, "# TYPE %s counter\n%s %s\n", name, name, formatFloat(c.value()))
+		case isLabeled:
+			sort.Strings(labels)
+			fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+			for _, l := range labels {
+				fmt.Fprintf(bw, "%s{%s} %s\n", name, l, formatFloat(series[l].value()))
+			}
+		case isGauge:
+			fmt.Fprintf(bw, "# TYPE %s gauge\n%s %s\n", name, name, formatFloat(g.value()))
+		case isHistogram:
+			fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+			h.writeTo(bw, name, "")
+		case isLabeledHistogram:
+			sort.Strings(labels)
+			fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+			for _, l := range labels {
+				histogramSeries[l].writeTo(bw, name, l)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP implements /metrics handler
+func (r *prometheusRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.write(w)
+}
+
+// labelValueReplacer escapes label value in prometheus text format
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type prometheusCounter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+// Add increases counter, negative values are ignored as prometheus counters are monotonic
+func (c *prometheusCounter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.v += delta
+	c.mu.Unlock()
+}
+
+func (c *prometheusCounter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v
+}
+
+type prometheusGauge struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (g *prometheusGauge) Add(delta float64) {
+	g.mu.Lock()
+	g.v += delta
+	g.mu.Unlock()
+}
+
+func (g *prometheusGauge) Set(value float64) {
+	g.mu.Lock()
+	g.v = value
+	g.mu.Unlock()
+}
+
+func (g *prometheusGauge) value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.v
+}
+
+type prometheusHistogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *prometheusHistogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+	h.mu.Unlock()
+}
+
+// writeTo writes cumulative buckets, sum and count of histogram with labels which may be empty
+func (h *prometheusHistogram) writeTo(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	bucketLabels, seriesLabels := "", ""
+	if labels != "" {
+		bucketLabels, seriesLabels = labels+",", "{"+labels+"}"
+	}
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, bucketLabels, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, seriesLabels, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, seriesLabels, count)
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusRegistry(t *testing.T) {
+	Convey("Prometheus registry", t, func() {
+		r := newPrometheusRegistry("elk", []float64{10, 100})
+		output := func() string {
+			var buf bytes.Buffer
+			So(r.write(&buf), ShouldBeNil)
+			return buf.String()
+		}
+
+		Convey("writes metrics sorted by name", func() {
+			c, err := r.counter("http.requests")
+			So(err, ShouldBeNil)
+			c.Add(2)
+			g, err := r.gauge("http.queue")
+			So(err, ShouldBeNil)
+			g.Set(3)
+			h, err := r.histogram("http.time")
+			So(err, ShouldBeNil)
+			h.Observe(50)
+			for _, index := range []string{"b", `a"b`} {
+				l, err := r.labeledCounter("http.index.messages", "index", index)
+				So(err, ShouldBeNil)
+				l.Add(1)
+			}
+			So(output(), ShouldEqual, `# TYPE elk_http_index_messages_total counter
+elk_http_index_messages_total{index="a\"b"} 1
+elk_http_index_messages_total{index="b"} 1
+# TYPE elk_http_queue gauge
+elk_http_queue 3
+# TYPE elk_http_requests_total counter
+elk_http_requests_total 2
+# TYPE elk_http_time histogram
+elk_http_time_bucket{le="10"} 0
+elk_http_time_bucket{le="100"} 1
+elk_http_time_bucket{le="+Inf"} 1
+elk_http_time_sum 50
+elk_http_time_count 1
+`)
+		})
+
+		Convey("writes labeled histograms as one metric", func() {
+			for _, code := range []string{"500", "200"} {
+				h, err := r.labeledHistogram("http.duration", "code", code)
+				So(err, ShouldBeNil)
+				h.Observe(5)
+			}
+			So(output(), ShouldEqual, `# TYPE elk_http_duration histogram
+elk_http_duration_bucket{code="200",le="10"} 1
+elk_http_duration_bucket{code="200",le="100"} 1
+elk_http_duration_bucket{code="200",le="+Inf"} 1
+elk_http_duration_sum{code="200"} 5
+elk_http_duration_count{code="200"} 1
+elk_http_duration_bucket{code="500",le="10"} 1
+elk_http_duration_bucket{code="500",le="100"} 1
+elk_http_duration_bucket{code="500",le="+Inf"} 1
+elk_http_duration_sum{code="500"} 5
+elk_http_duration_count{code="500"} 1
+`)
+		})
+
+		Convey("does not add _total suffix twice", func() {
+			_, err := r.counter("amqp.dead_letters.total")
+			So(err, ShouldBeNil)
+			So(output(), ShouldEqual, "# TYPE elk_amqp_dead_letters_total counter\nelk_amqp_dead_letters_total 0\n")
+		})
+
+		Convey("returns the same metric for the same name", func() {
+			first, _ := r.counter("http.requests")
+			second, err := r.counter("http_requests")
+			So(err, ShouldBeNil)
+			So(second, ShouldEqual, first)
+		})
+
+		Convey("rejects name used by metric of another kind", func() {
+			_, err := r.counter("http.requests")
+			So(err, ShouldBeNil)
+			_, err = r.gauge("http.requests_total")
+			So(err, ShouldNotBeNil)
+			_, err = r.histogram("http_requests_total")
+			So(err, ShouldNotBeNil)
+			_, err = r.labeledCounter("http.requests", "index", "a")
+			So(err, ShouldNotBeNil)
+			_, err = r.labeledHistogram("http.requests_total", "code", "200")
+			So(err, ShouldNotBeNil)
+			So(output(), ShouldEqual, "# TYPE elk_http_requests_total counter\nelk_http_requests_total 0\n")
+		})
+	})
+}
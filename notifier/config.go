@@ -1,18 +1,16 @@
 package notifier
 
-// MailConfig of smtp sender
-type MailConfig struct {
-	From        string `yaml:"from"`
-	SMTPHost    string `yaml:"host"`
-	SMTPPort    int    `yaml:"port"`
-	InsecureTLS bool   `yaml:"insecure_tls"`
-}
-
-type Sender interface{}
+import (
+	"github.com/AlexAkulov/candy-elk/notifier/meta"
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+	"github.com/AlexAkulov/candy-elk/notifier/sender"
+)
 
 // Config setting
 type Config struct {
-	ElasticUrls []string `yaml:"elasticsearch_url"`
-	Senders     []Sender `yaml:"senders"`
-	StatsD      string   `yaml:"statsd"`
+	ElasticUrls []string         `yaml:"elasticsearch_url"`
+	Senders     []sender.Config  `yaml:"senders"`
+	StatsD      string           `yaml:"statsd"`
+	Rules       meta.Config      `yaml:"rules"`
+	Scheduler   scheduler.Config `yaml:"scheduler"`
 }
@@ -0,0 +1,48 @@
+package meta
+
+import (
+	"fmt"
+)
+
+const (
+	// SourceElasticsearch reads alert metas from esd index only
+	SourceElasticsearch = "elasticsearch"
+	// SourceFiles reads alert metas from rule files only, esd index is not used
+	SourceFiles = "files"
+	// SourceMerge reads alert metas from both esd index and rule files
+	SourceMerge = "merge"
+
+	// DefaultReloadInterval of rule files in seconds
+	DefaultReloadInterval = 10
+)
+
+// Config settings of alert rules sources, path is a YAML or JSON file or a directory of such files
+type Config struct {
+	Source         string `yaml:"source"`
+	Path           string `yaml:"path"`
+	ReloadInterval int64  `yaml:"reload_interval"`
+}
+
+func (c Config) check() error {
+	switch c.Source {
+	case "", SourceElasticsearch:
+		return nil
+	case SourceFiles, SourceMerge:
+		if c.Path == "" {
+			return fmt.Errorf("path is required for %s rules source", c.Source)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown rules source %q", c.Source)
+	}
+}
+
+// UseElasticsearch returned true when alert metas are read from esd index
+func (c Config) UseElasticsearch() bool {
+	return c.Source != SourceFiles
+}
+
+// UseFiles returned true when alert metas are read from rule files
+func (c Config) UseFiles() bool {
+	return c.Source == SourceFiles || c.Source == SourceMerge
+}
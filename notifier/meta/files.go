@@ -0,0 +1,170 @@
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ruleFiles is a state of rule files loaded from config path
+type ruleFiles struct {
+	path     string
+	modTimes map[string]time.Time
+	metas    map[string][]*AlertMeta
+}
+
+// listRuleFiles returned path or YAML and JSON files from path directory
+func listRuleFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readRuleFile decodes a list of alert metas or a single alert meta from YAML or JSON file,
+// the file is a list if its first meaningful line starts with '-' or '['
+func readRuleFile(file string) ([]*AlertMeta, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if isRuleList(data) {
+		var metas []*AlertMeta
+		if err := yaml.Unmarshal(data, &metas); err != nil {
+			return nil, err
+		}
+		return metas, nil
+	}
+	single := &AlertMeta{}
+	if err := yaml.Unmarshal(data, single); err != nil {
+		return nil, err
+	}
+	return []*AlertMeta{single}, nil
+}
+
+// isRuleList returned true if data is a YAML sequence or JSON array,
+// empty lines, comments and document start marker are skipped
+func isRuleList(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || bytes.HasPrefix(line, []byte("---")) {
+			continue
+		}
+		return line[0] == '[' || line[0] == '-' && (len(line) == 1 || line[1] == ' ' || line[1] == '\t')
+	}
+	return false
+}
+
+// reloadRuleFiles loads rule files if any of them was changed, it returned true when rules were reloaded.
+// Rules which can't be parsed are skipped, previous rules are kept when a file can't be read
+func (m *Updater) reloadRuleFiles() (bool, error) {
+	path := m.Config.Path
+	files, err := listRuleFiles(path)
+	if err != nil {
+		return false, fmt.Errorf("can't read rules: %v", err)
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("can't read rules: %v", err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+	m.mu.RLock()
+	changed := path != m.files.path || len(modTimes) != len(m.files.modTimes)
+	for file, modTime := range modTimes {
+		if !m.files.modTimes[file].Equal(modTime) {
+			changed = true
+		}
+	}
+	m.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	newMetas := make(map[string][]*AlertMeta)
+	ids := make(map[string]string)
+	for _, file := range files {
+		metas, err := readRuleFile(file)
+		if err != nil {
+			return false, fmt.Errorf("can't parse rules file %s: %v", file, err)
+		}
+		for _, item := range metas {
+			if item == nil {
+				continue
+			}
+			if item.ID == "" {
+				item.ID = item.Name
+			}
+			if item.ID == "" {
+				m.Log.Error("msg", "Can't parse alert meta", "file", file, "err", "id or name is required")
+				continue
+			}
+			if other, ok := ids[item.ID]; ok {
+				m.Log.Error("msg", "Can't parse alert meta", "file", file, "id", item.ID, "err", "id is already used in "+other)
+				continue
+			}
+			if item.IndexTemplate == "" {
+				m.Log.Error("msg", "Can't parse alert meta", "file", file, "id", item.ID, "err", "index_template is required")
+				continue
+			}
+			if err := item.parse(); err != nil {
+				m.Log.Error("msg", "Can't parse alert meta", "file", file, "id", item.ID, "err", err)
+				continue
+			}
+			ids[item.ID] = file
+			newMetas[item.IndexTemplate] = append(newMetas[item.IndexTemplate], item)
+		}
+	}
+
+	m.mu.Lock()
+	m.files = ruleFiles{path: path, modTimes: modTimes, metas: newMetas}
+	m.mergeAlertMetas()
+	m.mu.Unlock()
+	return true, nil
+}
+
+// watchRuleFiles polls rule files for changes until updater is stopped
+func (m *Updater) watchRuleFiles() error {
+	interval := time.Duration(m.Config.ReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultReloadInterval * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.tomb.Dying():
+			return nil
+		case <-ticker.C:
+			reloaded, err := m.reloadRuleFiles()
+			if err != nil {
+				m.Log.Error("msg", "can't reload rules, previous rules are used", "err", err)
+				continue
+			}
+			if reloaded {
+				m.Log.Info("msg", "rules were reloaded", "path", m.Config.Path)
+			}
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package meta
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/AlexAkulov/candy-elk"
 )
 
@@ -13,84 +18,242 @@ func (u *Updater) MatchEvent(m *elkstreams.DecodedLogMessage) []*AlertMeta {
 		return nil
 	}
 	indexTemplate := m.IndexName[0 : indexNameLength-indexSuffixLength]
+	u.mu.RLock()
 	indexMetas, ok := u.alertMetas[indexTemplate]
+	eventMetas := u.eventMetas[indexTemplate]
+	u.mu.RUnlock()
 	if !ok {
 		return nil
 	}
 
 	ignored := false
 	if excHashField, fieldOk := m.Fields["exc_stacktrace_hash"]; fieldOk {
-		excHash := excHashField.(string)
-		if metas, metasOk := u.eventMetas[indexTemplate]; metasOk {
-			if meta, metaOk := metas[excHash]; metaOk {
-				ignored = meta.Ignored
-				if u.stats != nil && len(meta.Metric) > 0 {
-					u.stats.Incr(meta.Metric, 1)
-				}
+		excHash, _ := excHashField.(string)
+		if meta, metaOk := eventMetas[excHash]; metaOk {
+			ignored = meta.Ignored
+			if u.Stats != nil && len(meta.Metric) > 0 {
+				u.Stats.Incr(meta.Metric, 1)
 			}
 		}
 	}
 
 	var result []*AlertMeta
 	for _, meta := range indexMetas {
-		matched := 0
 		if !meta.ApplyToIgnored && ignored {
 			continue
 		}
-		for _, filter := range meta.Filters {
-			field, ok := m.Fields[filter.Field]
-			if !ok {
-				break
-			}
-			if field == nil {
-				u.Log.Debug("msg", "empty field", "field", filter.Field, "index", m.IndexName, "trigger", meta.Name)
+		if u.matchAll(meta.Filters, m, meta) {
+			result = append(result, meta)
+		}
+	}
+	return result
+}
+
+func (u *Updater) matchAll(filters []*Filter, m *elkstreams.DecodedLogMessage, meta *AlertMeta) bool {
+	for _, filter := range filters {
+		if !u.matchFilter(filter, m, meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFilter checks field conditions and groups of filter
+func (u *Updater) matchFilter(filter *Filter, m *elkstreams.DecodedLogMessage, meta *AlertMeta) bool {
+	if len(filter.Any) > 0 {
+		matched := false
+		for _, f := range filter.Any {
+			if u.matchFilter(f, m, meta) {
+				matched = true
 				break
 			}
-			var (
-				value float64
-				bytes []byte
-			)
-			switch t := field.(type) {
-			case string:
-				bytes = []byte(field.(string))
-			case []byte:
-				bytes = field.([]byte)
-			case int:
-				value = float64(field.(int))
-			case int32:
-				value = float64(field.(int32))
-			case int64:
-				value = float64(field.(int64))
-			case float32:
-				value = float64(field.(float32))
-			case float64:
-				value = field.(float64)
-			default:
-				u.Log.Debug("msg", "Unsupported field type", "type", t, "index", m.IndexName, "trigger", meta.Name, "field", filter.Field)
-				break
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(filter.All) > 0 && !u.matchAll(filter.All, m, meta) {
+		return false
+	}
+	if filter.Not != nil && u.matchFilter(filter.Not, m, meta) {
+		return false
+	}
+	if filter.Field == "" {
+		// legacy filter without field never matches
+		return len(filter.Any)+len(filter.All) > 0 || filter.Not != nil
+	}
+
+	field, ok := lookupField(m.Fields, filter.Field, filter.path)
+	if !ok || field == nil {
+		if ok {
+			u.Log.Debug("msg", "empty field", "field", filter.Field, "index", m.IndexName, "trigger", meta.Name)
+		}
+		return filter.NotExists
+	}
+	if filter.NotExists {
+		return false
+	}
+
+	if filter.compiledRegexp != nil || filter.inValues != nil || filter.Contains != "" || filter.Prefix != "" {
+		str, ok := fieldString(field)
+		if !ok {
+			u.Log.Debug("msg", "Unsupported field type", "type", fmt.Sprintf("%T", field), "index", m.IndexName, "trigger", meta.Name, "field", filter.Field)
+			return false
+		}
+		if filter.compiledRegexp != nil && !filter.compiledRegexp.MatchString(str) {
+			return false
+		}
+		if filter.IgnoreCase {
+			str = strings.ToLower(str)
+		}
+		if filter.inValues != nil {
+			if _, ok := filter.inValues[str]; !ok {
+				return false
 			}
-			if filter.compiledRegexp != nil && !filter.compiledRegexp.Match(bytes) {
-				break
+		}
+		if filter.Contains != "" && !strings.Contains(str, filter.contains) {
+			return false
+		}
+		if filter.Prefix != "" && !strings.HasPrefix(str, filter.prefix) {
+			return false
+		}
+	}
+
+	if filter.compareFunction != nil {
+		var value float64
+		switch t := field.(type) {
+		case string, []byte:
+			str, _ := fieldString(field)
+			v, err := getFloatValue(filter.Field, str)
+			if err != nil {
+				u.Log.Debug("msg", "Can't get float64 value", "value", str, "field", filter.Field, "err", err)
+				return false
 			}
-			if filter.compareFunction != nil {
-				if len(bytes) > 0 {
-					v, err := getFloatValue(filter.Field, string(bytes))
-					if err != nil {
-						u.Log.Debug("Can't get float64 value from %s of field %s", string(bytes), filter.Field)
-						break
-					}
-					value = v
-				}
-
-				if !filter.compareFunction(value, filter.LimitValue) {
-					break
-				}
+			value = v
+		case int:
+			value = float64(t)
+		case int32:
+			value = float64(t)
+		case int64:
+			value = float64(t)
+		case float32:
+			value = float64(t)
+		case float64:
+			value = t
+		default:
+			u.Log.Debug("msg", "Unsupported field type", "type", fmt.Sprintf("%T", field), "index", m.IndexName, "trigger", meta.Name, "field", filter.Field)
+			return false
+		}
+		if !filter.compareFunction(value, filter.LimitValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField returned field by name or by its dot separated path in nested objects
+func lookupField(fields map[string]interface{}, name string, path []string) (interface{}, bool) {
+	if field, ok := fields[name]; ok || len(path) < 2 {
+		return field, ok
+	}
+	var field interface{} = fields
+	for _, key := range path {
+		object, ok := field.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if field, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return field, true
+}
+
+// fieldString returned string representation of scalar field value
+func fieldString(field interface{}) (string, bool) {
+	switch t := field.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case int:
+		return strconv.Itoa(t), true
+	case int32:
+		return strconv.FormatInt(int64(t), 10), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// parse compile regexp, init limit value and values of string conditions of filter and its groups
+func (filter *Filter) parse() error {
+	var err error
+	hasCondition := filter.Exists || filter.NotExists || filter.In != nil || filter.Contains != "" || filter.Prefix != "" ||
+		filter.Regexp != "" || filter.CompareFunctionName != ""
+	if filter.Field == "" && hasCondition && (len(filter.Any)+len(filter.All) > 0 || filter.Not != nil) {
+		return fmt.Errorf("field is required for conditions of filter with groups")
+	}
+	if filter.Exists && filter.NotExists {
+		return fmt.Errorf("exists and not_exists of field %s can't be used together", filter.Field)
+	}
+	filter.path = strings.Split(filter.Field, ".")
+
+	if len(filter.Regexp) > 0 {
+		expr := filter.Regexp
+		if filter.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		if filter.compiledRegexp, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("can not compile regexp %s: %s", filter.Regexp, err)
+		}
+	}
+	if len(filter.CompareFunctionName) > 0 {
+		cf, ok := CompareFunctions[filter.CompareFunctionName]
+		if !ok {
+			return fmt.Errorf("compare function %s is not defined", filter.CompareFunctionName)
+		}
+		filter.compareFunction = cf
+		filter.LimitValue, err = getFloatValue(filter.Field, filter.Limit)
+		if err != nil {
+			return fmt.Errorf("can not get limit value %s: %s", filter.Limit, err)
+		}
+	}
+
+	normalize := func(s string) string {
+		if filter.IgnoreCase {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	if filter.In != nil {
+		filter.inValues = make(map[string]struct{}, len(filter.In))
+		for _, v := range filter.In {
+			str, ok := fieldString(v)
+			if !ok {
+				return fmt.Errorf("unsupported value %v in list of field %s", v, filter.Field)
 			}
-			matched++
+			filter.inValues[normalize(str)] = struct{}{}
 		}
-		if matched == len(meta.Filters) {
-			result = append(result, meta)
+	}
+	filter.contains = normalize(filter.Contains)
+	filter.prefix = normalize(filter.Prefix)
+
+	for _, group := range [][]*Filter{filter.Any, filter.All, {filter.Not}} {
+		for _, f := range group {
+			if f == nil {
+				continue
+			}
+			if err := f.parse(); err != nil {
+				return err
+			}
 		}
 	}
-	return result
+	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/quipo/statsd"
@@ -35,21 +36,37 @@ var CompareFunctions = map[string]CompareFunc{
 	},
 }
 
-// Updater read settigs from elasticsearch every minute
-type Matcher struct {
+// Updater read settigs from elasticsearch every minute and from rule files
+type Updater struct {
+	Config   Config
 	Log      elkstreams.Logger
 	ESClient *elastic.Client
+	Stats    statsd.Statsd
 
+	mu         sync.RWMutex
 	alertMetas map[string][]*AlertMeta
 	eventMetas map[string]map[string]*EventMeta
+	esMetas    map[string][]*AlertMeta
+	files      ruleFiles
 
-	tomb *tomb.Tomb
-
-	stats statsd.Statsd
+	tomb tomb.Tomb
 }
 
 // Start Updater
 func (m *Updater) Start() error {
+	if err := m.Config.check(); err != nil {
+		return err
+	}
+	if m.Config.UseFiles() {
+		if _, err := m.reloadRuleFiles(); err != nil {
+			return err
+		}
+		m.tomb.Go(m.watchRuleFiles)
+	}
+	if !m.Config.UseElasticsearch() {
+		return nil
+	}
+
 	if err := m.readAlertMetas(); err != nil {
 		return err
 	}
@@ -83,26 +100,41 @@ func (m *Updater) Stop() error {
 	return m.tomb.Wait()
 }
 
-// Filter describes field and matching condition (regexp or limit)
+// Filter describes field and matching conditions or a group of filters,
+// all conditions of filter must match, any matches if one of its filters matches
+// and all matches if every of its filters matches, filter without field and groups never matches as in legacy alerts
 type Filter struct {
-	CompareFunctionName string `json:"compare_function"`
-	Field               string `json:"field"`
-	Limit               string `json:"limit"`
-	Regexp              string `json:"regexp"`
+	CompareFunctionName string        `json:"compare_function" yaml:"compare_function"`
+	Field               string        `json:"field" yaml:"field"`
+	Limit               string        `json:"limit" yaml:"limit"`
+	Regexp              string        `json:"regexp" yaml:"regexp"`
+	IgnoreCase          bool          `json:"ignore_case" yaml:"ignore_case"`
+	Exists              bool          `json:"exists" yaml:"exists"`
+	NotExists           bool          `json:"not_exists" yaml:"not_exists"`
+	In                  []interface{} `json:"in" yaml:"in"`
+	Contains            string        `json:"contains" yaml:"contains"`
+	Prefix              string        `json:"prefix" yaml:"prefix"`
+	Any                 []*Filter     `json:"any" yaml:"any"`
+	All                 []*Filter     `json:"all" yaml:"all"`
+	Not                 *Filter       `json:"not" yaml:"not"`
 	compiledRegexp      *regexp.Regexp
 	compareFunction     CompareFunc
-	LimitValue          float64
+	LimitValue          float64 `yaml:"-"`
+	path                []string
+	inValues            map[string]struct{}
+	contains            string
+	prefix              string
 }
 
-// AlertMeta config for alerting criteria
+// AlertMeta config for alerting criteria, ID of rule from file is its name if it is not set
 type AlertMeta struct {
-	ID             string
-	Filters        []*Filter `json:"filters"`
-	IndexTemplate  string    `json:"index_template"`
-	Name           string    `json:"name"`
-	Recipient      string    `json:"recipient"`
-	SenderType     string    `json:"sender_type"`
-	ApplyToIgnored bool      `json:"ignored"`
+	ID             string    `yaml:"id"`
+	Filters        []*Filter `json:"filters" yaml:"filters"`
+	IndexTemplate  string    `json:"index_template" yaml:"index_template"`
+	Name           string    `json:"name" yaml:"name"`
+	Recipient      string    `json:"recipient" yaml:"recipient"`
+	SenderType     string    `json:"sender_type" yaml:"sender_type"`
+	ApplyToIgnored bool      `json:"ignored" yaml:"ignored"`
 }
 
 // EventMeta config for display logging event
@@ -116,29 +148,26 @@ type EventMeta struct {
 // Alert contains matched message and AlertMetas
 type Alert struct {
 	Metas     []*AlertMeta
-	Message   *elkstreams.LogMessage
+	Message   *elkstreams.DecodedLogMessage
 	Timestamp time.Time
 }
 
-// Parse compile regexp and init limit value
+// mergeAlertMetas combines alert metas of elasticsearch and rule files, it must be called under lock
+func (m *Updater) mergeAlertMetas() {
+	merged := make(map[string][]*AlertMeta, len(m.esMetas)+len(m.files.metas))
+	for _, metas := range []map[string][]*AlertMeta{m.esMetas, m.files.metas} {
+		for indexTemplate, list := range metas {
+			merged[indexTemplate] = append(merged[indexTemplate], list...)
+		}
+	}
+	m.alertMetas = merged
+}
+
+// Parse compile regexp and init limit value of filters
 func (alertMeta *AlertMeta) parse() error {
-	var err error
 	for _, filter := range alertMeta.Filters {
-		if len(filter.Regexp) > 0 {
-			if filter.compiledRegexp, err = regexp.Compile(filter.Regexp); err != nil {
-				return fmt.Errorf("can not compile regexp %s: %s", filter.Regexp, err)
-			}
-		}
-		if len(filter.CompareFunctionName) > 0 {
-			cf, ok := CompareFunctions[filter.CompareFunctionName]
-			if !ok {
-				return fmt.Errorf("compare function %s is not defined", filter.CompareFunctionName)
-			}
-			filter.compareFunction = cf
-			filter.LimitValue, err = getFloatValue(filter.Field, filter.Limit)
-			if err != nil {
-				return fmt.Errorf("can not get limit value %s: %s", filter.Limit, err)
-			}
+		if err := filter.parse(); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -177,7 +206,10 @@ func (m *Updater) readAlertMetas() error {
 		}
 		scrollID = searchResult.ScrollId
 	}
-	m.alertMetas = newMetas
+	m.mu.Lock()
+	m.esMetas = newMetas
+	m.mergeAlertMetas()
+	m.mu.Unlock()
 	return nil
 }
 
@@ -210,6 +242,8 @@ func (m *Updater) readEventMetas() error {
 		}
 		scrollID = searchResult.ScrollId
 	}
+	m.mu.Lock()
 	m.eventMetas = newMetas
+	m.mu.Unlock()
 	return nil
 }
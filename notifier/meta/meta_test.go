@@ -0,0 +1,241 @@
+package meta
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+
+	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/logger"
+)
+
+func TestRuleFiles(t *testing.T) {
+	Convey("Rule files", t, func() {
+		dir, err := ioutil.TempDir("", "elkalert-rules")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		write := func(name, content string, modTime time.Time) {
+			file := filepath.Join(dir, name)
+			So(ioutil.WriteFile(file, []byte(content), 0644), ShouldBeNil)
+			So(os.Chtimes(file, modTime, modTime), ShouldBeNil)
+		}
+		start := time.Now().Add(-time.Hour)
+		write("errors.yml", `
+- name: errors
+  index_template: project
+  recipient: dev@example.com
+  filters:
+  - field: level
+    compare_function: greater_or_equal
+    limit: error
+- name: broken
+  index_template: project
+  filters:
+  - field: message
+    regexp: "("
+- name: without index
+`, start)
+		write("slow.json", `{"id": "slow", "name": "slow", "index_template": "api", "sender_type": "slack",
+			"filters": [{"field": "duration", "compare_function": "greater", "limit": "1000"}]}`, start)
+		write("README.md", "not a rule", start)
+		write("single.yaml", `# single rule
+---
+name: single
+index_template: single
+filters:
+- field: level
+  in: [error]
+`, start)
+		write("other.yml", `
+- name: errors
+  index_template: other
+- index_template: other
+`, start)
+
+		u := &Updater{
+			Config: Config{Source: SourceFiles, Path: dir},
+			Log:    logger.NewNopLogger(),
+		}
+		match := func(index string, fields map[string]interface{}) []string {
+			var names []string
+			for _, m := range u.MatchEvent(&elkstreams.DecodedLogMessage{IndexName: index, Fields: fields}) {
+				names = append(names, m.Name)
+			}
+			return names
+		}
+
+		reloaded, err := u.reloadRuleFiles()
+		So(err, ShouldBeNil)
+		So(reloaded, ShouldBeTrue)
+
+		Convey("Valid rules are loaded from YAML and JSON files", func() {
+			So(u.alertMetas["project"], ShouldHaveLength, 1)
+			So(u.alertMetas["project"][0].ID, ShouldEqual, "errors")
+			So(u.alertMetas["project"][0].Recipient, ShouldEqual, "dev@example.com")
+			So(u.alertMetas["api"], ShouldHaveLength, 1)
+			So(u.alertMetas["api"][0].ID, ShouldEqual, "slow")
+			So(u.alertMetas["api"][0].SenderType, ShouldEqual, "slack")
+
+			So(match("project-2018-01-01", map[string]interface{}{"level": "fatal"}), ShouldResemble, []string{"errors"})
+			So(match("project-2018-01-01", map[string]interface{}{"level": "info"}), ShouldBeEmpty)
+			So(match("api-2018-01-01", map[string]interface{}{"duration": float64(1500)}), ShouldResemble, []string{"slow"})
+			So(match("single-2018-01-01", map[string]interface{}{"level": "error"}), ShouldResemble, []string{"single"})
+		})
+
+		Convey("Rules with duplicated or without id and name are skipped", func() {
+			So(u.alertMetas["other"], ShouldBeEmpty)
+		})
+
+		Convey("Error of a list is returned as is", func() {
+			write("errors.yml", "- name: errors\n  filters: {field: level}\n", start.Add(time.Minute))
+			_, err := u.reloadRuleFiles()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "[]*meta.Filter")
+		})
+
+		Convey("Unchanged files are not reloaded", func() {
+			reloaded, err := u.reloadRuleFiles()
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldBeFalse)
+		})
+
+		Convey("Changed files are reloaded", func() {
+			write("slow.json", `[]`, start.Add(time.Minute))
+			reloaded, err := u.reloadRuleFiles()
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldBeTrue)
+			So(u.alertMetas["api"], ShouldBeEmpty)
+			So(u.alertMetas["project"], ShouldHaveLength, 1)
+		})
+
+		Convey("Previous rules are kept when a file is broken", func() {
+			write("slow.json", `{"name": [`, start.Add(time.Minute))
+			reloaded, err := u.reloadRuleFiles()
+			So(err, ShouldNotBeNil)
+			So(reloaded, ShouldBeFalse)
+			So(u.alertMetas["api"], ShouldHaveLength, 1)
+		})
+
+		Convey("Rules are merged with elasticsearch rules", func() {
+			u.Config.Source = SourceMerge
+			u.mu.Lock()
+			u.esMetas = map[string][]*AlertMeta{
+				"project": []*AlertMeta{&AlertMeta{ID: "es", Name: "from esd", IndexTemplate: "project"}},
+			}
+			u.mergeAlertMetas()
+			u.mu.Unlock()
+			So(u.alertMetas["project"], ShouldHaveLength, 2)
+			So(match("project-2018-01-01", map[string]interface{}{"level": "error"}), ShouldResemble, []string{"from esd", "errors"})
+		})
+	})
+
+	Convey("Rules source config", t, func() {
+		So(Config{}.check(), ShouldBeNil)
+		So(Config{}.UseElasticsearch(), ShouldBeTrue)
+		So(Config{}.UseFiles(), ShouldBeFalse)
+		So(Config{Source: SourceFiles}.check(), ShouldNotBeNil)
+		So(Config{Source: SourceFiles, Path: "rules"}.UseElasticsearch(), ShouldBeFalse)
+		So(Config{Source: SourceMerge, Path: "rules"}.UseElasticsearch(), ShouldBeTrue)
+		So(Config{Source: SourceMerge, Path: "rules"}.UseFiles(), ShouldBeTrue)
+		So(Config{Source: "consul"}.check(), ShouldNotBeNil)
+	})
+}
+
+func TestMatchEvent(t *testing.T) {
+	Convey("Filters", t, func() {
+		u := &Updater{Log: logger.NewNopLogger()}
+		match := func(filters string, fields map[string]interface{}) bool {
+			item := &AlertMeta{}
+			So(yaml.Unmarshal([]byte(filters), &item.Filters), ShouldBeNil)
+			So(item.parse(), ShouldBeNil)
+			return u.matchAll(item.Filters, &elkstreams.DecodedLogMessage{IndexName: "project-2018-01-01", Fields: fields}, item)
+		}
+		event := map[string]interface{}{
+			"level":   "Error",
+			"message": "Connection refused by upstream",
+			"host":    "web-01",
+			"request": map[string]interface{}{
+				"status": float64(502),
+				"method": "POST",
+			},
+			"request.id": "abc",
+		}
+
+		Convey("Legacy filters are AND-ed", func() {
+			So(match(`[{field: level, compare_function: greater_or_equal, limit: error}, {field: message, regexp: "refused"}]`, event), ShouldBeTrue)
+			So(match(`[{field: level, compare_function: greater_or_equal, limit: error}, {field: message, regexp: "timeout"}]`, event), ShouldBeFalse)
+			So(match(`[{field: missing, regexp: "."}]`, event), ShouldBeFalse)
+			So(match(`[{field: host}]`, event), ShouldBeTrue)
+		})
+
+		Convey("Legacy esd documents are decoded", func() {
+			item := &AlertMeta{}
+			So(json.Unmarshal([]byte(`{"filters": [{"field": "level", "compare_function": "greater", "limit": "warn", "regexp": ""}]}`), item), ShouldBeNil)
+			So(item.parse(), ShouldBeNil)
+			So(u.matchAll(item.Filters, &elkstreams.DecodedLogMessage{Fields: event}, item), ShouldBeTrue)
+		})
+
+		Convey("Legacy filters without field never match", func() {
+			So(match(`[{regexp: "."}]`, event), ShouldBeFalse)
+			So(match(`[{}]`, event), ShouldBeFalse)
+
+			item := &AlertMeta{}
+			So(json.Unmarshal([]byte(`{"filters": [{"field": "", "regexp": "refused"}, {"field": "level", "regexp": "Error"}]}`), item), ShouldBeNil)
+			So(item.parse(), ShouldBeNil)
+			So(u.matchAll(item.Filters, &elkstreams.DecodedLogMessage{Fields: event}, item), ShouldBeFalse)
+		})
+
+		Convey("Any, all and not", func() {
+			So(match(`[{any: [{field: host, prefix: db-}, {field: host, prefix: web-}]}]`, event), ShouldBeTrue)
+			So(match(`[{any: [{field: host, prefix: db-}, {field: host, prefix: cache-}]}]`, event), ShouldBeFalse)
+			So(match(`[{all: [{field: host, prefix: web-}, {not: {field: level, in: [Debug, Info]}}]}]`, event), ShouldBeTrue)
+			So(match(`[{not: {field: message, contains: refused}}]`, event), ShouldBeFalse)
+		})
+
+		Convey("Exists and not_exists", func() {
+			So(match(`[{field: host, exists: true}]`, event), ShouldBeTrue)
+			So(match(`[{field: user, exists: true}]`, event), ShouldBeFalse)
+			So(match(`[{field: user, not_exists: true}]`, event), ShouldBeTrue)
+			So(match(`[{field: request.method, not_exists: true}]`, event), ShouldBeFalse)
+		})
+
+		Convey("In, contains and prefix", func() {
+			So(match(`[{field: request.status, in: [500, 502, 503]}]`, event), ShouldBeTrue)
+			So(match(`[{field: request.status, in: [500]}]`, event), ShouldBeFalse)
+			So(match(`[{field: level, in: [error, fatal]}]`, event), ShouldBeFalse)
+			So(match(`[{field: level, in: [error, fatal], ignore_case: true}]`, event), ShouldBeTrue)
+			So(match(`[{field: message, contains: "by upstream"}]`, event), ShouldBeTrue)
+			So(match(`[{field: message, contains: "UPSTREAM", ignore_case: true}]`, event), ShouldBeTrue)
+			So(match(`[{field: message, prefix: "connection"}]`, event), ShouldBeFalse)
+		})
+
+		Convey("Nested fields and case-insensitive regexp", func() {
+			So(match(`[{field: request.status, compare_function: greater_or_equal, limit: "500"}]`, event), ShouldBeTrue)
+			So(match(`[{field: request.status, regexp: "^5\\d\\d$"}]`, event), ShouldBeTrue)
+			So(match(`[{field: request.id, regexp: "^abc$"}]`, event), ShouldBeTrue)
+			So(match(`[{field: request.method.name, exists: true}]`, event), ShouldBeFalse)
+			So(match(`[{field: message, regexp: "^connection"}]`, event), ShouldBeFalse)
+			So(match(`[{field: message, regexp: "^connection", ignore_case: true}]`, event), ShouldBeTrue)
+		})
+
+		Convey("Invalid filters are rejected", func() {
+			for _, filters := range []string{
+				`[{regexp: ".", any: [{field: host, exists: true}]}]`,
+				`[{field: host, exists: true, not_exists: true}]`,
+				`[{any: [{field: host, regexp: "("}]}]`,
+				`[{field: level, compare_function: between, limit: "1"}]`,
+			} {
+				item := &AlertMeta{}
+				So(yaml.Unmarshal([]byte(filters), &item.Filters), ShouldBeNil)
+				So(item.parse(), ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -1,15 +1,26 @@
 package notifier
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
-
+	"github.com/quipo/statsd"
 	"gopkg.in/olivere/elastic.v3"
+	"gopkg.in/tomb.v2"
 
 	"github.com/AlexAkulov/candy-elk"
 	"github.com/AlexAkulov/candy-elk/notifier/meta"
 	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+	"github.com/AlexAkulov/candy-elk/notifier/sender"
+)
+
+const (
+	// senderWorkers is a number of notifications sent concurrently by each sender
+	senderWorkers = 4
+	// senderQueueSize is a number of notifications waiting for workers of each sender
+	senderQueueSize = 100
 )
 
 // Publisher is an implementation of elkstreams.Publisher interface for sending Notifications
@@ -17,76 +28,170 @@ type Publisher struct {
 	Config Config
 	Log    elkstreams.Logger
 	es     *elastic.Client
+	stats  *statsd.StatsdClient
 
-	metaUpdater *meta.Updater
-	s *scheduler.Scheduler
-
-
+	metaUpdater   *meta.Updater
+	senders       map[string]sender.Sender
+	scheduler     *scheduler.Scheduler
+	notifications chan scheduler.Notification
+	tomb          tomb.Tomb
 }
 
-// Start initializes Elasticsearch connection
+// Start initializes Elasticsearch connection, alert metas updater and scheduler
 func (p *Publisher) Start() error {
 	var err error
-	p.es, err = elastic.NewClient(
-		elastic.SetURL(p.Config.ElasticUrls...),
-		elastic.SetErrorLog(p.Log),
-		elastic.SetHealthcheck(true),
-		elastic.SetHealthcheckTimeoutStartup(time.Second),
-		)
-	if err != nil {
+	if p.senders, err = sender.NewSenders(p.Config.Senders); err != nil {
 		return err
 	}
-	p.Log.Debug("msg", "elasticsearch connected")
+
+	if p.Config.Rules.UseElasticsearch() {
+		p.es, err = elastic.NewClient(
+			elastic.SetURL(p.Config.ElasticUrls...),
+			elastic.SetErrorLog(p.Log),
+			elastic.SetHealthcheck(true),
+			elastic.SetHealthcheckTimeoutStartup(time.Second),
+		)
+		if err != nil {
+			return err
+		}
+		p.Log.Debug("msg", "elasticsearch connected")
+	}
 
 	p.metaUpdater = &meta.Updater{
-		Log: p.Log,
+		Config:   p.Config.Rules,
+		Log:      p.Log,
 		ESClient: p.es,
 	}
+	if p.Config.StatsD != "" {
+		p.stats = statsd.NewStatsdClient(p.Config.StatsD, "")
+		if err := p.stats.CreateSocket(); err != nil {
+			return fmt.Errorf("can't connect to statsd: %v", err)
+		}
+		p.metaUpdater.Stats = p.stats
+	}
 
 	if err := p.metaUpdater.Start(); err != nil {
-		return fmt.Errorf("Can't start meta updater: %v", err)
+		return fmt.Errorf("can't start meta updater: %v", err)
 	}
 
-	p.s := &scheduler.Scheduler{
-		Log: p.Log,
-	}
+	p.notifications = make(chan scheduler.Notification)
+	p.tomb.Go(p.notify)
 
-	if err := p.s.Start(); err != nil {
-		return fmt.Errorf("Can't start sheduller: %v", err)
+	p.scheduler = &scheduler.Scheduler{
+		Config:        p.Config.Scheduler,
+		Log:           p.Log,
+		Notifications: p.notifications,
+	}
+	if err := p.scheduler.Start(); err != nil {
+		return fmt.Errorf("can't start scheduler: %v", err)
 	}
 
-	return err
+	return nil
 }
 
-// Stop flushes and stops publishing
+// Stop sends collected notifications and stops publishing
 func (p *Publisher) Stop() error {
 	if err := p.metaUpdater.Stop(); err != nil {
 		p.Log.Debug("msg", "stop metaUpdater failed", "err", err)
 	}
 
-	if err := p.s.Stop(); err != nil {
-		p.Log.Debug("msg", "stop sheduller failed", "err", err)
+	if err := p.scheduler.Stop(); err != nil {
+		p.Log.Debug("msg", "stop scheduler failed", "err", err)
 	}
+	close(p.notifications)
+	p.tomb.Wait()
 
-	p.Log.Debug("msg", "stop elastic")
-	p.es.Stop()
-	p.Log.Debug("msg", "elastic stopped")
+	if p.stats != nil {
+		p.stats.Close()
+	}
+
+	if p.es != nil {
+		p.Log.Debug("msg", "stop elastic")
+		p.es.Stop()
+		p.Log.Debug("msg", "elastic stopped")
+	}
 	return nil
 }
 
-// Publish add messages to bulk in Elastic
+// Publish matches messages with alert metas and passes matched ones to scheduler
 func (p *Publisher) Publish(bulk []*elkstreams.LogMessage) error {
-	for i := range bulk {
-		metas = p.metaUpdater.MatchEvent(bulk[i])
-		if len(metas) > 0 {
-			alert := Alert{
+	now := time.Now()
+	for _, m := range bulk {
+		decoded, err := decodeMessage(m)
+		if err != nil {
+			p.Log.Warn("msg", "can't decode message", "index", m.IndexName, "err", err)
+		} else if metas := p.metaUpdater.MatchEvent(decoded); len(metas) > 0 {
+			p.scheduler.Add(meta.Alert{
 				Metas:     metas,
-				Message:   m,
-				Timestamp: time.Now(),
-			}
-			p.s.Add(alert)
+				Message:   decoded,
+				Timestamp: now,
+			})
+		}
+		if m.Ack != nil {
+			m.Ack.Done()
 		}
-	 }
+	}
+	return nil
+}
+
+// notify is receiving notifications from scheduler and passes them to fixed pool of workers of their senders,
+// so slow sender does not delay others, it returns when channel is closed and all notifications are sent
+func (p *Publisher) notify() error {
+	var wg sync.WaitGroup
+	queues := make(map[string]chan scheduler.Notification, len(p.senders))
+	for senderType, s := range p.senders {
+		queue := make(chan scheduler.Notification, senderQueueSize)
+		queues[senderType] = queue
+		for i := 0; i < senderWorkers; i++ {
+			wg.Add(1)
+			go func(s sender.Sender, senderType string) {
+				defer wg.Done()
+				for notification := range queue {
+					p.send(s, senderType, notification)
+				}
+			}(s, senderType)
+		}
+	}
+
+	for notification := range p.notifications {
+		senderType := notification.SenderType
+		if senderType == "" {
+			senderType = sender.DefaultSenderType
+		}
+		queue, ok := queues[senderType]
+		if !ok {
+			p.Log.Error("msg", "sender is not configured", "sender_type", senderType, "to", notification.Recipient)
+			continue
+		}
+		select {
+		case queue <- notification:
+		default:
+			p.Log.Error("msg", "queue of sender is full, notification is dropped", "sender_type", senderType, "to", notification.Recipient)
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
 	return nil
 }
 
+func (p *Publisher) send(s sender.Sender, senderType string, notification scheduler.Notification) {
+	if err := s.Send(notification); err != nil {
+		p.Log.Error("msg", "can't send notification", "sender_type", senderType, "to", notification.Recipient, "err", err)
+		return
+	}
+	p.Log.Debug("msg", "notification sent", "sender_type", senderType, "to", notification.Recipient, "alerts", len(notification.AlertsData))
+}
+
+// decodeMessage unmarshals JSON body of message to fields
+func decodeMessage(m *elkstreams.LogMessage) (*elkstreams.DecodedLogMessage, error) {
+	decoded := &elkstreams.DecodedLogMessage{
+		IndexName: m.IndexName,
+		IndexType: m.IndexType,
+	}
+	if err := json.Unmarshal(m.Body, &decoded.Fields); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
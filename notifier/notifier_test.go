@@ -0,0 +1,60 @@
+package notifier
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/AlexAkulov/candy-elk/logger"
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+	"github.com/AlexAkulov/candy-elk/notifier/sender"
+)
+
+// chanSender passes notifications to channel
+type chanSender chan scheduler.Notification
+
+func (s chanSender) Send(notification scheduler.Notification) error {
+	s <- notification
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	Convey("Notifications", t, func() {
+		mail, slack := make(chanSender), make(chanSender, 1)
+		p := &Publisher{
+			Log:           logger.NewNopLogger(),
+			senders:       map[string]sender.Sender{sender.TypeMail: mail, sender.TypeSlack: slack},
+			notifications: make(chan scheduler.Notification),
+		}
+		done := make(chan error)
+		go func() { done <- p.notify() }()
+
+		Convey("are not delayed by slow sender", func() {
+			for i := 0; i < senderWorkers; i++ {
+				p.notifications <- scheduler.Notification{Recipient: "dev@example.com"}
+			}
+			p.notifications <- scheduler.Notification{Recipient: "ops", SenderType: sender.TypeSlack}
+			select {
+			case n := <-slack:
+				So(n.Recipient, ShouldEqual, "ops")
+			case <-time.After(time.Second):
+				So("slack notification was not sent", ShouldBeEmpty)
+			}
+
+			Convey("and are sent before notify returns", func() {
+				close(p.notifications)
+				for i := 0; i < senderWorkers; i++ {
+					So((<-mail).Recipient, ShouldEqual, "dev@example.com")
+				}
+				So(<-done, ShouldBeNil)
+			})
+		})
+
+		Convey("of unknown sender are skipped", func() {
+			p.notifications <- scheduler.Notification{Recipient: "dev", SenderType: "pager"}
+			close(p.notifications)
+			So(<-done, ShouldBeNil)
+		})
+	})
+}
@@ -1,23 +1,154 @@
 package scheduler
 
 import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/notifier/meta"
 )
 
+// Config settings of alerts aggregation
+type Config struct {
+	Window  int64 `yaml:"window"`
+	MaxRows int   `yaml:"max_rows"`
+}
+
+// AlertData is a row of notification, it contains the first matched message of alert and count of matches
+type AlertData struct {
+	ID      string
+	Name    string
+	Message *elkstreams.DecodedLogMessage
+	Count   int
+	First   time.Time
+	Last    time.Time
+}
+
+// Notification contains alerts of one recipient and sender type collected during the window
+type Notification struct {
+	Recipient  string
+	SenderType string
+	AlertsData []*AlertData
+	Skipped    int
+}
+
+// window collects alerts of one recipient and sender type until its end
+type window struct {
+	end          time.Time
+	notification *Notification
+	rows         map[string]*AlertData
+}
+
+// Scheduler groups alerts by recipient, sender type and AlertMeta and sends Notification to Notifications channel at the end of window
 type Scheduler struct {
-	Log    elkstreams.Logger
+	Config        Config
+	Log           elkstreams.Logger
+	Notifications chan<- Notification
+
+	mu      sync.Mutex
+	windows map[string]*window
+	tomb    tomb.Tomb
 }
 
+// Start runs flushing of finished windows
 func (s *Scheduler) Start() error {
+	s.windows = make(map[string]*window)
+	s.tomb.Go(func() error {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.tomb.Dying():
+				s.flush(time.Time{})
+				return nil
+			case now := <-ticker.C:
+				s.flush(now)
+			}
+		}
+	})
 	return nil
 }
 
+// Stop sends all collected alerts and stops scheduler
 func (s *Scheduler) Stop() error {
-	return nil
+	s.tomb.Kill(nil)
+	return s.tomb.Wait()
 }
 
+// Add puts alert to windows of recipients of its metas
+func (s *Scheduler) Add(alert meta.Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-func (s *Scheduler) Add() error {
+	for _, m := range alert.Metas {
+		if m.Recipient == "" {
+			s.Log.Debug("msg", "alert without recipient", "alert", m.Name)
+			continue
+		}
+		key := m.SenderType + "\x00" + m.Recipient
+		w, ok := s.windows[key]
+		if !ok {
+			w = &window{
+				end:          alert.Timestamp.Add(time.Duration(s.Config.Window) * time.Second),
+				notification: &Notification{Recipient: m.Recipient, SenderType: m.SenderType},
+				rows:         make(map[string]*AlertData),
+			}
+			s.windows[key] = w
+		}
+		id := m.ID
+		if id == "" {
+			id = m.Name
+		}
+		if row, ok := w.rows[id]; ok {
+			row.Count++
+			row.Last = alert.Timestamp
+			continue
+		}
+		if s.Config.MaxRows > 0 && len(w.rows) >= s.Config.MaxRows {
+			w.notification.Skipped++
+			continue
+		}
+		w.rows[id] = &AlertData{
+			ID:      id,
+			Name:    m.Name,
+			Message: alert.Message,
+			Count:   1,
+			First:   alert.Timestamp,
+			Last:    alert.Timestamp,
+		}
+	}
 	return nil
 }
 
+// flush sends notifications of windows finished before now, zero now flushes all windows
+func (s *Scheduler) flush(now time.Time) {
+	var notifications []Notification
+	s.mu.Lock()
+	for key, w := range s.windows {
+		if !now.IsZero() && now.Before(w.end) {
+			continue
+		}
+		delete(s.windows, key)
+		n := w.notification
+		for _, row := range w.rows {
+			n.AlertsData = append(n.AlertsData, row)
+		}
+		sort.Slice(n.AlertsData, func(i, j int) bool {
+			a, b := n.AlertsData[i], n.AlertsData[j]
+			if a.First.Equal(b.First) {
+				return a.ID < b.ID
+			}
+			return a.First.Before(b.First)
+		})
+		notifications = append(notifications, *n)
+	}
+	s.mu.Unlock()
+
+	for _, n := range notifications {
+		s.Log.Debug("msg", "notification is ready", "recipient", n.Recipient, "sender_type", n.SenderType, "alerts", len(n.AlertsData), "skipped", n.Skipped)
+		s.Notifications <- n
+	}
+}
@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/logger"
+	"github.com/AlexAkulov/candy-elk/notifier/meta"
+)
+
+func TestScheduler(t *testing.T) {
+	Convey("Scheduler", t, func() {
+		notifications := make(chan Notification, 10)
+		s := &Scheduler{
+			Config:        Config{Window: 60, MaxRows: 2},
+			Log:           logger.NewNopLogger(),
+			Notifications: notifications,
+			windows:       make(map[string]*window),
+		}
+		start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+		errors := &meta.AlertMeta{ID: "1", Name: "errors", Recipient: "dev@example.com"}
+		fatals := &meta.AlertMeta{ID: "2", Name: "fatals", Recipient: "dev@example.com"}
+		panics := &meta.AlertMeta{ID: "3", Name: "panics", Recipient: "dev@example.com"}
+		admins := &meta.AlertMeta{ID: "4", Name: "admins", Recipient: "ops@example.com"}
+		alert := func(offset time.Duration, message string, metas ...*meta.AlertMeta) meta.Alert {
+			return meta.Alert{
+				Metas:     metas,
+				Message:   &elkstreams.DecodedLogMessage{Fields: map[string]interface{}{"message": message}},
+				Timestamp: start.Add(offset),
+			}
+		}
+
+		Convey("Alerts are grouped by recipient and meta until the end of window", func() {
+			s.Add(alert(0, "first", errors, admins))
+			s.Add(alert(10*time.Second, "second", errors))
+			s.Add(alert(20*time.Second, "third", fatals))
+
+			s.flush(start.Add(59 * time.Second))
+			So(notifications, ShouldHaveLength, 0)
+
+			s.flush(start.Add(60 * time.Second))
+			So(notifications, ShouldHaveLength, 2)
+			byRecipient := make(map[string]Notification)
+			for i := 0; i < 2; i++ {
+				n := <-notifications
+				byRecipient[n.Recipient] = n
+			}
+
+			dev := byRecipient["dev@example.com"]
+			So(dev.AlertsData, ShouldHaveLength, 2)
+			So(dev.AlertsData[0].Name, ShouldEqual, "errors")
+			So(dev.AlertsData[0].Count, ShouldEqual, 2)
+			So(dev.AlertsData[0].Message.Fields["message"], ShouldEqual, "first")
+			So(dev.AlertsData[0].Last, ShouldEqual, start.Add(10*time.Second))
+			So(dev.AlertsData[1].Name, ShouldEqual, "fatals")
+			So(dev.AlertsData[1].Count, ShouldEqual, 1)
+
+			ops := byRecipient["ops@example.com"]
+			So(ops.AlertsData, ShouldHaveLength, 1)
+			So(ops.AlertsData[0].Name, ShouldEqual, "admins")
+
+			Convey("Next alert opens new window", func() {
+				s.Add(alert(70*time.Second, "fourth", errors))
+				s.flush(start.Add(100 * time.Second))
+				So(notifications, ShouldHaveLength, 0)
+				s.flush(start.Add(130 * time.Second))
+				So(notifications, ShouldHaveLength, 1)
+				n := <-notifications
+				So(n.AlertsData, ShouldHaveLength, 1)
+				So(n.AlertsData[0].Count, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Rows over max_rows are skipped", func() {
+			s.Add(alert(0, "first", errors, fatals, panics))
+			s.Add(alert(time.Second, "second", panics, errors))
+			s.flush(time.Time{})
+			So(notifications, ShouldHaveLength, 1)
+			n := <-notifications
+			So(n.AlertsData, ShouldHaveLength, 2)
+			So(n.AlertsData[0].Count, ShouldEqual, 2)
+			So(n.Skipped, ShouldEqual, 2)
+		})
+
+		Convey("Alerts of the same recipient are split by sender type", func() {
+			slack := &meta.AlertMeta{ID: "5", Name: "slack", Recipient: "dev@example.com", SenderType: "slack"}
+			s.Add(alert(0, "first", errors, slack))
+			s.flush(time.Time{})
+			So(notifications, ShouldHaveLength, 2)
+			bySender := make(map[string]Notification)
+			for i := 0; i < 2; i++ {
+				n := <-notifications
+				bySender[n.SenderType] = n
+			}
+			So(bySender[""].AlertsData[0].Name, ShouldEqual, "errors")
+			So(bySender["slack"].AlertsData[0].Name, ShouldEqual, "slack")
+			So(bySender["slack"].Recipient, ShouldEqual, "dev@example.com")
+		})
+
+		Convey("Alerts without recipient are ignored", func() {
+			s.Add(alert(0, "first", &meta.AlertMeta{ID: "6", Name: "nobody"}))
+			s.flush(time.Time{})
+			So(notifications, ShouldHaveLength, 0)
+		})
+	})
+}
@@ -1,7 +1,6 @@
-package scheduler
+package sender
 
 import (
-	"bytes"
 	"crypto/tls"
 	"html/template"
 	"io"
@@ -9,8 +8,14 @@ import (
 	gomail "gopkg.in/gomail.v2"
 
 	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
 )
 
+// Mail sends notifications via smtp server, recipient is an email address
+type Mail struct {
+	Config Config
+}
+
 var tpl = template.Must(template.New("mail").Parse(`
 <html>
 	<head>
@@ -43,6 +48,7 @@ var tpl = template.Must(template.New("mail").Parse(`
 				{{end}}
 			</tbody>
 		</table>
+		{{if .Skipped}}<p>{{ .Skipped }} more alerts were skipped</p>{{end}}
 		<p>Please, do something!</p>
 	</body>
 </html>
@@ -54,25 +60,14 @@ type templateRow struct {
 	Count   int
 }
 
-// MakeMessage is making smtp message from template
-func makeMessage(config *MailConfig, notification Notification) *gomail.Message {
-	var subjectBuffer bytes.Buffer
-	var subject string
-	for _, data := range notification.AlertsData {
-		subjectBuffer.WriteString(data.Name)
-		subjectBuffer.WriteRune(',')
-	}
-	if subjectBuffer.Len() > 0 {
-		subjectBuffer.Truncate(subjectBuffer.Len() - 1)
-		subject = subjectBuffer.String()
-	} else {
-		subject = "Error alert"
-	}
-
+// makeMessage is making smtp message from template
+func makeMessage(config Config, notification scheduler.Notification) *gomail.Message {
 	templateData := struct {
-		Items []*templateRow
+		Items   []*templateRow
+		Skipped int
 	}{
-		Items: make([]*templateRow, 0, len(notification.AlertsData)),
+		Items:   make([]*templateRow, 0, len(notification.AlertsData)),
+		Skipped: notification.Skipped,
 	}
 
 	for _, data := range notification.AlertsData {
@@ -86,7 +81,7 @@ func makeMessage(config *MailConfig, notification Notification) *gomail.Message
 	m := gomail.NewMessage()
 	m.SetHeader("From", config.From)
 	m.SetHeader("To", notification.Recipient)
-	m.SetHeader("Subject", subject)
+	m.SetHeader("Subject", subject(notification))
 	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
 		return tpl.Execute(w, templateData)
 	})
@@ -94,31 +89,18 @@ func makeMessage(config *MailConfig, notification Notification) *gomail.Message
 	return m
 }
 
-// SendNotification is making mail message and send it via smtp server
-func sendNotification(config *MailConfig, notification Notification) error {
-	m := MakeMessage(config, notification)
+// Send is making mail message and send it via smtp server
+func (s *Mail) Send(notification scheduler.Notification) error {
 	if len(notification.Recipient) == 0 {
 		return nil
 	}
+	m := makeMessage(s.Config, notification)
 	d := gomail.Dialer{
-		Host: config.SMTPHost,
-		Port: config.SMTPPort,
-		TLSConfig:
-		&tls.Config{
-			InsecureSkipVerify:
-			config.InsecureTLS,
+		Host: s.Config.SMTPHost,
+		Port: s.Config.SMTPPort,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: s.Config.InsecureTLS,
 		},
 	}
-	if err := d.DialAndSend(m); err != nil {
-		return err
-	}
-	log.Debugf("Successfully send notification for [%s] subject [%s]", m.GetHeader("To"), m.GetHeader("Subject"))
-	return nil
-}
-
-// StartNotifier is receiving notification from channel and send it
-func StartNotifier(config *MailConfig, ch <-chan Notification) {
-	for notification := range ch {
-		go SendNotification(config, notification)
-	}
+	return d.DialAndSend(m)
 }
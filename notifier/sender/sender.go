@@ -0,0 +1,183 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+)
+
+const (
+	// TypeMail sends notifications via smtp server
+	TypeMail = "mail"
+	// TypeSlack sends notifications to Slack incoming webhook
+	TypeSlack = "slack"
+	// TypeWebhook posts notifications as JSON to url
+	TypeWebhook = "webhook"
+	// TypeTelegram sends notifications via Telegram bot
+	TypeTelegram = "telegram"
+
+	// DefaultSenderType is used for alert metas without sender_type
+	DefaultSenderType = TypeMail
+	// DefaultSMTPPort is used for mail sender without port
+	DefaultSMTPPort = 25
+	// DefaultTimeout of http based senders in seconds
+	DefaultTimeout = 10
+	// DefaultTelegramURL is a Telegram Bot API url
+	DefaultTelegramURL = "https://api.telegram.org"
+)
+
+// Sender delivers notification to its recipient
+type Sender interface {
+	Send(notification scheduler.Notification) error
+}
+
+// Config of sender, sender is selected by name equal to sender_type of alert meta
+// and the name is type of sender by default
+type Config struct {
+	Name        string            `yaml:"name"`
+	Type        string            `yaml:"type"`
+	From        string            `yaml:"from"`
+	SMTPHost    string            `yaml:"host"`
+	SMTPPort    int               `yaml:"port"`
+	InsecureTLS bool              `yaml:"insecure_tls"`
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers"`
+	Token       string            `yaml:"token"`
+	Timeout     int64             `yaml:"timeout"`
+}
+
+// New creates sender by config type
+func New(config Config) (Sender, error) {
+	switch config.Type {
+	case TypeMail:
+		if config.SMTPHost == "" {
+			return nil, fmt.Errorf("host is required for %s sender", config.Type)
+		}
+		if config.SMTPPort == 0 {
+			config.SMTPPort = DefaultSMTPPort
+		}
+		return &Mail{Config: config}, nil
+	case TypeSlack:
+		if config.URL == "" {
+			return nil, fmt.Errorf("url is required for %s sender", config.Type)
+		}
+		return &Slack{Config: config, client: newHTTPClient(config)}, nil
+	case TypeWebhook:
+		if config.URL == "" {
+			return nil, fmt.Errorf("url is required for %s sender", config.Type)
+		}
+		return &Webhook{Config: config, client: newHTTPClient(config)}, nil
+	case TypeTelegram:
+		if config.Token == "" {
+			return nil, fmt.Errorf("token is required for %s sender", config.Type)
+		}
+		if config.URL == "" {
+			config.URL = DefaultTelegramURL
+		}
+		return &Telegram{Config: config, client: newHTTPClient(config)}, nil
+	default:
+		return nil, fmt.Errorf("unknown sender type %q", config.Type)
+	}
+}
+
+// NewSenders creates senders by their names
+func NewSenders(configs []Config) (map[string]Sender, error) {
+	senders := make(map[string]Sender, len(configs))
+	for _, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = config.Type
+		}
+		if _, ok := senders[name]; ok {
+			return nil, fmt.Errorf("sender %q is defined twice", name)
+		}
+		s, err := New(config)
+		if err != nil {
+			return nil, fmt.Errorf("sender %q: %v", name, err)
+		}
+		senders[name] = s
+	}
+	return senders, nil
+}
+
+func newHTTPClient(config Config) *http.Client {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+// postJSON posts payload and returns error if response status is not 2xx
+func postJSON(client *http.Client, url string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
+
+// subject joins names of alerts in notification
+func subject(notification scheduler.Notification) string {
+	names := make([]string, 0, len(notification.AlertsData))
+	for _, data := range notification.AlertsData {
+		names = append(names, data.Name)
+	}
+	if len(names) == 0 {
+		return "Error alert"
+	}
+	return strings.Join(names, ",")
+}
+
+// formatText is a plain text of notification for chat senders, one line per alert
+func formatText(notification scheduler.Notification) string {
+	var text bytes.Buffer
+	for _, data := range notification.AlertsData {
+		fmt.Fprintf(&text, "%s (%d): %s\n", data.Name, data.Count, messageText(data))
+	}
+	if notification.Skipped > 0 {
+		fmt.Fprintf(&text, "%d more alerts were skipped\n", notification.Skipped)
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// messageText is a message field of alert event or its fields if message is missing
+func messageText(data *scheduler.AlertData) string {
+	if data.Message == nil {
+		return ""
+	}
+	if message, ok := data.Message.Fields["message"].(string); ok {
+		return message
+	}
+	fields := make([]string, 0, len(data.Message.Fields))
+	for field, value := range data.Message.Fields {
+		fields = append(fields, fmt.Sprintf("%s=%v", field, value))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,162 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/AlexAkulov/candy-elk"
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+)
+
+// request is a request received by stand-in server
+type request struct {
+	Path    string
+	Headers http.Header
+	Body    map[string]interface{}
+}
+
+func TestSenders(t *testing.T) {
+	Convey("Senders", t, func() {
+		var (
+			requests []request
+			status   = http.StatusOK
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			req := request{Path: r.URL.Path, Headers: r.Header}
+			json.Unmarshal(body, &req.Body)
+			requests = append(requests, req)
+			w.WriteHeader(status)
+			w.Write([]byte("stand-in response"))
+		}))
+		defer server.Close()
+
+		first := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+		notification := scheduler.Notification{
+			Recipient:  "dev",
+			SenderType: "slack",
+			AlertsData: []*scheduler.AlertData{
+				&scheduler.AlertData{
+					ID:    "1",
+					Name:  "errors",
+					Count: 3,
+					First: first,
+					Last:  first.Add(time.Minute),
+					Message: &elkstreams.DecodedLogMessage{
+						IndexName: "project-2018.01.01",
+						IndexType: "LogEvent",
+						Fields:    map[string]interface{}{"message": "connection refused", "level": "error"},
+					},
+				},
+				&scheduler.AlertData{
+					ID:      "2",
+					Name:    "timeouts",
+					Count:   1,
+					Message: &elkstreams.DecodedLogMessage{Fields: map[string]interface{}{"status": 504.0}},
+				},
+			},
+			Skipped: 2,
+		}
+
+		Convey("Slack", func() {
+			s, err := New(Config{Type: TypeSlack, URL: server.URL + "/hook"})
+			So(err, ShouldBeNil)
+			So(s.Send(notification), ShouldBeNil)
+			So(requests, ShouldHaveLength, 1)
+			So(requests[0].Path, ShouldEqual, "/hook")
+			So(requests[0].Body["channel"], ShouldEqual, "dev")
+			So(requests[0].Body["text"], ShouldEqual, "*errors,timeouts*\n"+
+				"errors (3): connection refused\n"+
+				"timeouts (1): status=504\n"+
+				"2 more alerts were skipped")
+		})
+
+		Convey("Webhook", func() {
+			s, err := New(Config{Type: TypeWebhook, URL: server.URL + "/alerts", Headers: map[string]string{"Authorization": "Bearer secret"}})
+			So(err, ShouldBeNil)
+			So(s.Send(notification), ShouldBeNil)
+			So(requests, ShouldHaveLength, 1)
+			So(requests[0].Headers.Get("Authorization"), ShouldEqual, "Bearer secret")
+			So(requests[0].Headers.Get("Content-Type"), ShouldEqual, "application/json")
+			So(requests[0].Body["recipient"], ShouldEqual, "dev")
+			So(requests[0].Body["sender_type"], ShouldEqual, "slack")
+			So(requests[0].Body["skipped"], ShouldEqual, 2)
+			alerts := requests[0].Body["alerts"].([]interface{})
+			So(alerts, ShouldHaveLength, 2)
+			alert := alerts[0].(map[string]interface{})
+			So(alert["name"], ShouldEqual, "errors")
+			So(alert["count"], ShouldEqual, 3)
+			So(alert["index"], ShouldEqual, "project-2018.01.01")
+			So(alert["first"], ShouldEqual, "2018-01-01T00:00:00Z")
+			So(alert["fields"].(map[string]interface{})["message"], ShouldEqual, "connection refused")
+		})
+
+		Convey("Telegram", func() {
+			s, err := New(Config{Type: TypeTelegram, URL: server.URL + "/", Token: "123:abc"})
+			So(err, ShouldBeNil)
+			So(s.Send(notification), ShouldBeNil)
+			So(requests, ShouldHaveLength, 1)
+			So(requests[0].Path, ShouldEqual, "/bot123:abc/sendMessage")
+			So(requests[0].Body["chat_id"], ShouldEqual, "dev")
+			So(requests[0].Body["text"], ShouldStartWith, "errors,timeouts\nerrors (3): connection refused")
+
+			Convey("Long text is truncated", func() {
+				notification.AlertsData[0].Message.Fields["message"] = string(bytes.Repeat([]byte("x"), 5000))
+				So(s.Send(notification), ShouldBeNil)
+				So(requests, ShouldHaveLength, 2)
+				text := requests[1].Body["text"].(string)
+				So(len(text), ShouldEqual, telegramMaxLength)
+				So(text, ShouldEndWith, "...")
+			})
+		})
+
+		Convey("Error status is returned", func() {
+			status = http.StatusBadRequest
+			s, err := New(Config{Type: TypeWebhook, URL: server.URL})
+			So(err, ShouldBeNil)
+			err = s.Send(notification)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "unexpected response status 400: stand-in response")
+		})
+
+		Convey("Mail message", func() {
+			m := makeMessage(Config{From: "elkalert@example.com"}, notification)
+			So(m.GetHeader("From"), ShouldResemble, []string{"elkalert@example.com"})
+			So(m.GetHeader("To"), ShouldResemble, []string{"dev"})
+			So(m.GetHeader("Subject"), ShouldResemble, []string{"errors,timeouts"})
+			var body bytes.Buffer
+			_, err := m.WriteTo(&body)
+			So(err, ShouldBeNil)
+			So(body.String(), ShouldContainSubstring, "connection refused")
+			So(body.String(), ShouldContainSubstring, "2 more alerts were skipped")
+		})
+
+		Convey("Senders are created by names", func() {
+			senders, err := NewSenders([]Config{
+				Config{Type: TypeMail, SMTPHost: "localhost"},
+				Config{Name: "ops", Type: TypeSlack, URL: server.URL},
+			})
+			So(err, ShouldBeNil)
+			So(senders, ShouldHaveLength, 2)
+			So(senders[TypeMail].(*Mail).Config.SMTPPort, ShouldEqual, DefaultSMTPPort)
+			So(senders["ops"], ShouldHaveSameTypeAs, &Slack{})
+
+			_, err = NewSenders([]Config{Config{Type: TypeSlack}})
+			So(err, ShouldNotBeNil)
+			_, err = NewSenders([]Config{Config{Type: "pager"}})
+			So(err, ShouldNotBeNil)
+			_, err = NewSenders([]Config{
+				Config{Type: TypeSlack, URL: server.URL},
+				Config{Type: TypeSlack, URL: server.URL},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,27 @@
+package sender
+
+import (
+	"net/http"
+
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+)
+
+// Slack posts notifications to Slack incoming webhook, recipient is sent as a channel which overrides
+// default channel of legacy webhooks only, webhooks of Slack apps ignore it and always post to their own channel
+type Slack struct {
+	Config Config
+	client *http.Client
+}
+
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// Send posts notification text to webhook url
+func (s *Slack) Send(notification scheduler.Notification) error {
+	return postJSON(s.client, s.Config.URL, s.Config.Headers, &slackMessage{
+		Channel: notification.Recipient,
+		Text:    "*" + subject(notification) + "*\n" + formatText(notification),
+	})
+}
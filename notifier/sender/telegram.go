@@ -0,0 +1,40 @@
+package sender
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+)
+
+// telegramMaxLength is a limit of message text in Telegram Bot API
+const telegramMaxLength = 4096
+
+// Telegram sends notifications via Telegram bot, recipient is a chat id or @channel
+type Telegram struct {
+	Config Config
+	client *http.Client
+}
+
+type telegramMessage struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+// Send calls sendMessage method of Bot API
+func (s *Telegram) Send(notification scheduler.Notification) error {
+	if len(notification.Recipient) == 0 {
+		return nil
+	}
+	text := subject(notification) + "\n" + formatText(notification)
+	if runes := []rune(text); len(runes) > telegramMaxLength {
+		text = string(runes[:telegramMaxLength-3]) + "..."
+	}
+	url := strings.TrimSuffix(s.Config.URL, "/") + "/bot" + s.Config.Token + "/sendMessage"
+	return postJSON(s.client, url, s.Config.Headers, &telegramMessage{
+		ChatID:                notification.Recipient,
+		Text:                  text,
+		DisableWebPagePreview: true,
+	})
+}
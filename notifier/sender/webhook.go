@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AlexAkulov/candy-elk/notifier/scheduler"
+)
+
+// Webhook posts notifications as JSON documents to url with configured headers
+type Webhook struct {
+	Config Config
+	client *http.Client
+}
+
+type webhookNotification struct {
+	Recipient  string          `json:"recipient"`
+	SenderType string          `json:"sender_type"`
+	Alerts     []*webhookAlert `json:"alerts"`
+	Skipped    int             `json:"skipped"`
+}
+
+type webhookAlert struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Count     int                    `json:"count"`
+	First     time.Time              `json:"first"`
+	Last      time.Time              `json:"last"`
+	IndexName string                 `json:"index,omitempty"`
+	IndexType string                 `json:"type,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Send posts notification to url
+func (s *Webhook) Send(notification scheduler.Notification) error {
+	payload := &webhookNotification{
+		Recipient:  notification.Recipient,
+		SenderType: notification.SenderType,
+		Alerts:     make([]*webhookAlert, 0, len(notification.AlertsData)),
+		Skipped:    notification.Skipped,
+	}
+	for _, data := range notification.AlertsData {
+		alert := &webhookAlert{
+			ID:    data.ID,
+			Name:  data.Name,
+			Count: data.Count,
+			First: data.First,
+			Last:  data.Last,
+		}
+		if data.Message != nil {
+			alert.IndexName = data.Message.IndexName
+			alert.IndexType = data.Message.IndexType
+			alert.Fields = data.Message.Fields
+		}
+		payload.Alerts = append(payload.Alerts, alert)
+	}
+	return postJSON(s.client, s.Config.URL, s.Config.Headers, payload)
+}